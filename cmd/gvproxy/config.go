@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// GvproxyConfig is the content of the file given with -config.
+// JSON files are accepted too since JSON is a subset of YAML.
+// Flags given on the command line take precedence over the values of the file.
+type GvproxyConfig struct {
+	// Control endpoints, same as -listen
+	Listen []string `yaml:"listen,omitempty"`
+
+	// Sockets used by the virtual machines
+	Interfaces struct {
+		VPNKit string `yaml:"vpnkit,omitempty"`
+		Qemu   string `yaml:"qemu,omitempty"`
+		Bess   string `yaml:"bess,omitempty"`
+		Stdio  string `yaml:"stdio,omitempty"`
+		Vfkit  string `yaml:"vfkit,omitempty"`
+	} `yaml:"interfaces,omitempty"`
+
+	// SOCKS5 and HTTP CONNECT proxy giving access to the virtual network, same as -listen-proxy
+	Proxy string `yaml:"proxy,omitempty"`
+
+	// Virtual network. The fields that are set replace the ones of the built-in 192.168.127.0/24 network,
+	// the others keep their default value.
+	Stack *types.Configuration `yaml:"stack,omitempty"`
+
+	SSHPort int    `yaml:"sshPort,omitempty"`
+	PidFile string `yaml:"pidFile,omitempty"`
+}
+
+func loadConfig(path string) (*GvproxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config GvproxyConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "cannot parse %s", path)
+	}
+	return &config, nil
+}
+
+// applyFlags sets the flag values from the configuration file, unless they were given on the command line.
+func (c *GvproxyConfig) applyFlags() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	setString := func(name string, value string, target *string) {
+		if !set[name] && value != "" {
+			*target = value
+		}
+	}
+	setString("listen-vpnkit", c.Interfaces.VPNKit, &vpnkitSocket)
+	setString("listen-qemu", c.Interfaces.Qemu, &qemuSocket)
+	setString("listen-bess", c.Interfaces.Bess, &bessSocket)
+	setString("listen-stdio", c.Interfaces.Stdio, &stdioSocket)
+	setString("listen-vfkit", c.Interfaces.Vfkit, &vfkitSocket)
+	setString("listen-proxy", c.Proxy, &proxySocket)
+	setString("pid-file", c.PidFile, &pidFile)
+
+	if !set["listen"] && len(c.Listen) > 0 {
+		endpoints = c.Listen
+	}
+	if !set["ssh-port"] && c.SSHPort != 0 {
+		sshPort = c.SSHPort
+	}
+	if c.Stack != nil {
+		if !set["debug"] && c.Stack.Debug {
+			debug = true
+		}
+		if !set["ntp"] && c.Stack.NTP {
+			ntp = true
+		}
+		if !set["mtu"] && c.Stack.MTU != 0 {
+			mtu = c.Stack.MTU
+		}
+	}
+}
+
+// mergeConfiguration replaces the fields of the configuration with the ones set in the file.
+// Lists and maps are replaced as a whole, they are not merged with the default ones.
+func mergeConfiguration(configuration *types.Configuration, file *types.Configuration) {
+	target := reflect.ValueOf(configuration).Elem()
+	source := reflect.ValueOf(file).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		if !source.Field(i).IsZero() {
+			target.Field(i).Set(source.Field(i))
+		}
+	}
+}
+
+// flagGiven returns whether the flag was given on the command line.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// sshForward returns the address of the SSH server of the virtual machine, the destination of the forward of the
+// ssh port.
+func sshForward(configuration *types.Configuration, port int) (string, bool) {
+	for local, remote := range configuration.Forwards {
+		if _, localPort, err := net.SplitHostPort(local); err == nil && localPort == strconv.Itoa(port) {
+			return remote, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadYAMLConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gvproxy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+listen:
+  - unix:///tmp/network.sock
+  - tcp://127.0.0.1:7777
+interfaces:
+  qemu: unix:///tmp/qemu.sock
+sshPort: 2223
+proxy: tcp://127.0.0.1:1080
+stack:
+  mtu: 4000
+  subnet: 192.168.200.0/24
+  gatewayIP: 192.168.200.1
+  gatewayMacAddress: 5a:94:ef:e4:0c:dd
+  dhcpStaticLeases:
+    192.168.200.2: 5a:94:ef:e4:0c:ee
+  dns:
+    - name: containers.internal.
+      records:
+        - name: gateway
+          ip: 192.168.200.1
+        - regexp: ".*"
+          ip: 192.168.200.254
+  forwards:
+    127.0.0.1:2223: 192.168.200.2:22
+  nat:
+    192.168.200.254: 127.0.0.1
+`), 0600))
+
+	config, err := loadConfig(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"unix:///tmp/network.sock", "tcp://127.0.0.1:7777"}, config.Listen)
+	assert.Equal(t, "unix:///tmp/qemu.sock", config.Interfaces.Qemu)
+	assert.Equal(t, 2223, config.SSHPort)
+	assert.Equal(t, "tcp://127.0.0.1:1080", config.Proxy)
+	assert.NotNil(t, config.Stack)
+	assert.Equal(t, 4000, config.Stack.MTU)
+	assert.Equal(t, "192.168.200.0/24", config.Stack.Subnet)
+	assert.Equal(t, map[string]string{"192.168.200.2": "5a:94:ef:e4:0c:ee"}, config.Stack.DHCPStaticLeases)
+	assert.Equal(t, map[string]string{"127.0.0.1:2223": "192.168.200.2:22"}, config.Stack.Forwards)
+	assert.Equal(t, map[string]string{"192.168.200.254": "127.0.0.1"}, config.Stack.NAT)
+	assert.Len(t, config.Stack.DNS, 1)
+	assert.Len(t, config.Stack.DNS[0].Records, 2)
+	assert.Equal(t, net.ParseIP("192.168.200.1"), config.Stack.DNS[0].Records[0].IP)
+	assert.Equal(t, ".*", config.Stack.DNS[0].Records[1].Regexp.String())
+}
+
+func TestLoadJSONConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gvproxy.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+  "interfaces": {"vfkit": "unixgram:///tmp/vfkit.sock"},
+  "stack": {"subnet": "10.0.0.0/24", "gatewayIP": "10.0.0.1", "gatewayVirtualIPs": ["10.0.0.254"]}
+}`), 0600))
+
+	config, err := loadConfig(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "unixgram:///tmp/vfkit.sock", config.Interfaces.Vfkit)
+	assert.NotNil(t, config.Stack)
+	assert.Equal(t, "10.0.0.1", config.Stack.GatewayIP)
+	assert.Equal(t, []string{"10.0.0.254"}, config.Stack.GatewayVirtualIPs)
+}
+
+func TestLoadPartialStackConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gvproxy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("stack:\n  mtu: 4000\n  dnsSearchDomains: [example.com]\n"), 0600))
+
+	config, err := loadConfig(path)
+	assert.NoError(t, err)
+
+	configuration := defaultConfiguration(types.QemuProtocol)
+	mergeConfiguration(&configuration, config.Stack)
+
+	assert.Equal(t, 4000, configuration.MTU)
+	assert.Equal(t, []string{"example.com"}, configuration.DNSSearchDomains)
+	assert.Equal(t, "192.168.127.0/24", configuration.Subnet)
+	assert.Equal(t, "192.168.127.1", configuration.GatewayIP)
+	assert.Equal(t, map[string]string{"192.168.127.2": "5a:94:ef:e4:0c:ee"}, configuration.DHCPStaticLeases)
+	assert.Equal(t, map[string]string{"192.168.127.254": "127.0.0.1"}, configuration.NAT)
+	assert.Len(t, configuration.DNS, 2)
+	assert.Equal(t, types.QemuProtocol, configuration.Protocol)
+	target, ok := sshForward(&configuration, sshPort)
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.127.2:22", target)
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gvproxy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("stack:\n  subnets: 10.0.0.0/24\n"), 0600))
+
+	_, err := loadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestLoadConfigInvalidRecord(t *testing.T) {
+	for _, record := range []string{`regexp: "("`, `names: gateway`} {
+		path := filepath.Join(t.TempDir(), "gvproxy.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte("stack:\n  dns:\n    - name: containers.internal.\n      records:\n        - "+record+"\n"), 0600))
+
+		_, err := loadConfig(path)
+		assert.Error(t, err, record)
+	}
+}
+
+func TestSSHForward(t *testing.T) {
+	configuration := &types.Configuration{
+		Forwards: map[string]string{
+			"127.0.0.1:8080": "192.168.200.2:80",
+			"127.0.0.1:2223": "192.168.200.2:22",
+		},
+	}
+	target, ok := sshForward(configuration, 2223)
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.200.2:22", target)
+	_, ok = sshForward(configuration, 2222)
+	assert.False(t, ok)
+}
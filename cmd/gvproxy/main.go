@@ -32,18 +32,21 @@ import (
 var (
 	debug           bool
 	mtu             int
+	ntp             bool
 	endpoints       arrayFlags
 	vpnkitSocket    string
 	qemuSocket      string
 	bessSocket      string
 	stdioSocket     string
 	vfkitSocket     string
+	proxySocket     string
 	forwardSocket   arrayFlags
 	forwardDest     arrayFlags
 	forwardUser     arrayFlags
 	forwardIdentify arrayFlags
 	sshPort         int
 	pidFile         string
+	configFile      string
 	exitCode        int
 )
 
@@ -61,17 +64,20 @@ func main() {
 	flag.Var(&endpoints, "listen", "control endpoint")
 	flag.BoolVar(&debug, "debug", false, "Print debug info")
 	flag.IntVar(&mtu, "mtu", 1500, "Set the MTU")
+	flag.BoolVar(&ntp, "ntp", false, "Run a SNTP server on the gateway, advertised with DHCP")
 	flag.IntVar(&sshPort, "ssh-port", 2222, "Port to access the guest virtual machine. Must be between 1024 and 65535")
 	flag.StringVar(&vpnkitSocket, "listen-vpnkit", "", "VPNKit socket to be used by Hyperkit")
 	flag.StringVar(&qemuSocket, "listen-qemu", "", "Socket to be used by Qemu")
 	flag.StringVar(&bessSocket, "listen-bess", "", "unixpacket socket to be used by Bess-compatible applications")
 	flag.StringVar(&stdioSocket, "listen-stdio", "", "accept stdio pipe")
 	flag.StringVar(&vfkitSocket, "listen-vfkit", "", "unixgram socket to be used by vfkit-compatible applications")
+	flag.StringVar(&proxySocket, "listen-proxy", "", "SOCKS5 and HTTP CONNECT proxy giving access to the virtual network (e.g. tcp://127.0.0.1:1080)")
 	flag.Var(&forwardSocket, "forward-sock", "Forwards a unix socket to the guest virtual machine over SSH")
 	flag.Var(&forwardDest, "forward-dest", "Forwards a unix socket to the guest virtual machine over SSH")
 	flag.Var(&forwardUser, "forward-user", "SSH user to use for unix socket forward")
 	flag.Var(&forwardIdentify, "forward-identity", "Path to SSH identity key for forwarding")
 	flag.StringVar(&pidFile, "pid-file", "", "Generate a file with the PID in it")
+	flag.StringVar(&configFile, "config", "", "YAML or JSON file describing the virtual network and the listeners")
 	flag.Parse()
 
 	if version.ShowVersion() {
@@ -79,6 +85,16 @@ func main() {
 		os.Exit(0)
 	}
 
+	var fileConfig *GvproxyConfig
+	if configFile != "" {
+		var err error
+		fileConfig, err = loadConfig(configFile)
+		if err != nil {
+			exitWithError(errors.Wrap(err, "cannot load configuration file"))
+		}
+		fileConfig.applyFlags()
+	}
+
 	log.Infof(version.String())
 	ctx, cancel := context.WithCancel(context.Background())
 	// Make this the last defer statement in the stack
@@ -187,7 +203,63 @@ func main() {
 		}
 	}
 
-	config := types.Configuration{
+	config := defaultConfiguration(protocol)
+	if fileConfig != nil && fileConfig.Stack != nil {
+		mergeConfiguration(&config, fileConfig.Stack)
+		config.Debug = debug
+		config.MTU = mtu
+		config.NTP = ntp
+		config.Protocol = protocol
+		// the built-in forward of the ssh port is replaced by the forwards of the file
+		if _, ok := sshForward(&config, sshPort); !ok && fileConfig.Stack.Forwards != nil &&
+			(len(forwardSocket) > 0 || fileConfig.SSHPort != 0 || flagGiven("ssh-port")) {
+			exitWithError(fmt.Errorf("-ssh-port and -forward-sock need a forward of port %d in the stack configuration", sshPort))
+		}
+	}
+
+	groupErrs.Go(func() error {
+		return run(ctx, groupErrs, &config, endpoints)
+	})
+
+	// Wait for something to happen
+	groupErrs.Go(func() error {
+		select {
+		// Catch signals so exits are graceful and defers can run
+		case <-sigChan:
+			cancel()
+			return errors.New("signal caught")
+		case <-ctx.Done():
+			return nil
+		}
+	})
+	// Wait for all of the go funcs to finish up
+	if err := groupErrs.Wait(); err != nil {
+		log.Error(err)
+		exitCode = 1
+	}
+}
+
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return "my string representation"
+}
+
+func (i *arrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+func captureFile() string {
+	if !debug {
+		return ""
+	}
+	return "capture.pcap"
+}
+
+// defaultConfiguration returns the built-in 192.168.127.0/24 network, set up with the flags.
+func defaultConfiguration(protocol types.Protocol) types.Configuration {
+	return types.Configuration{
 		Debug:             debug,
 		CaptureFile:       captureFile(),
 		MTU:               mtu,
@@ -226,6 +298,7 @@ func main() {
 			},
 		},
 		DNSSearchDomains: searchDomains(),
+		NTP:              ntp,
 		Forwards: map[string]string{
 			fmt.Sprintf("127.0.0.1:%d", sshPort): sshHostPort,
 		},
@@ -238,45 +311,6 @@ func main() {
 		},
 		Protocol: protocol,
 	}
-
-	groupErrs.Go(func() error {
-		return run(ctx, groupErrs, &config, endpoints)
-	})
-
-	// Wait for something to happen
-	groupErrs.Go(func() error {
-		select {
-		// Catch signals so exits are graceful and defers can run
-		case <-sigChan:
-			cancel()
-			return errors.New("signal caught")
-		case <-ctx.Done():
-			return nil
-		}
-	})
-	// Wait for all of the go funcs to finish up
-	if err := groupErrs.Wait(); err != nil {
-		log.Error(err)
-		exitCode = 1
-	}
-}
-
-type arrayFlags []string
-
-func (i *arrayFlags) String() string {
-	return "my string representation"
-}
-
-func (i *arrayFlags) Set(value string) error {
-	*i = append(*i, value)
-	return nil
-}
-
-func captureFile() string {
-	if !debug {
-		return ""
-	}
-	return "capture.pcap"
 }
 
 func run(ctx context.Context, g *errgroup.Group, configuration *types.Configuration, endpoints []string) error {
@@ -295,7 +329,7 @@ func run(ctx context.Context, g *errgroup.Group, configuration *types.Configurat
 		httpServe(ctx, g, ln, withProfiler(vn))
 	}
 
-	ln, err := vn.Listen("tcp", fmt.Sprintf("%s:80", gatewayIP))
+	ln, err := vn.Listen("tcp", fmt.Sprintf("%s:80", configuration.GatewayIP))
 	if err != nil {
 		return err
 	}
@@ -347,6 +381,26 @@ func run(ctx context.Context, g *errgroup.Group, configuration *types.Configurat
 		})
 	}
 
+	if proxySocket != "" {
+		proxyListener, err := transport.Listen(proxySocket)
+		if err != nil {
+			return err
+		}
+
+		g.Go(func() error {
+			<-ctx.Done()
+			return proxyListener.Close()
+		})
+
+		g.Go(func() error {
+			err := vn.ServeProxy(proxyListener)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "proxy accept error")
+		})
+	}
+
 	if qemuSocket != "" {
 		qemuListener, err := transport.Listen(qemuSocket)
 		if err != nil {
@@ -362,12 +416,20 @@ func run(ctx context.Context, g *errgroup.Group, configuration *types.Configurat
 		})
 
 		g.Go(func() error {
-			conn, err := qemuListener.Accept()
-			if err != nil {
-				return errors.Wrap(err, "qemu accept error")
-
+			for {
+				conn, err := qemuListener.Accept()
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return errors.Wrap(err, "qemu accept error")
+				}
+				g.Go(func() error {
+					// errors are logged by the switch, a VM restart must not stop gvproxy
+					_ = vn.AcceptQemu(ctx, conn)
+					return nil
+				})
 			}
-			return vn.AcceptQemu(ctx, conn)
 		})
 	}
 
@@ -386,12 +448,19 @@ func run(ctx context.Context, g *errgroup.Group, configuration *types.Configurat
 		})
 
 		g.Go(func() error {
-			conn, err := bessListener.Accept()
-			if err != nil {
-				return errors.Wrap(err, "bess accept error")
-
+			for {
+				conn, err := bessListener.Accept()
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return errors.Wrap(err, "bess accept error")
+				}
+				g.Go(func() error {
+					_ = vn.AcceptBess(ctx, conn)
+					return nil
+				})
 			}
-			return vn.AcceptBess(ctx, conn)
 		})
 	}
 
@@ -400,21 +469,33 @@ func run(ctx context.Context, g *errgroup.Group, configuration *types.Configurat
 		if err != nil {
 			return err
 		}
+		vfkitListener, err := transport.NewVfkitListener(conn)
+		if err != nil {
+			return err
+		}
 
 		g.Go(func() error {
 			<-ctx.Done()
-			if err := conn.Close(); err != nil {
+			if err := vfkitListener.Close(); err != nil {
 				log.Errorf("error closing %s: %q", vfkitSocket, err)
 			}
 			return os.Remove(vfkitSocket)
 		})
 
 		g.Go(func() error {
-			vfkitConn, err := transport.AcceptVfkit(conn)
-			if err != nil {
-				return err
+			for {
+				vfkitConn, err := vfkitListener.Accept()
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return errors.Wrap(err, "vfkit accept error")
+				}
+				g.Go(func() error {
+					_ = vn.AcceptVfkit(ctx, vfkitConn)
+					return nil
+				})
 			}
-			return vn.AcceptVfkit(ctx, vfkitConn)
 		})
 	}
 
@@ -425,6 +506,7 @@ func run(ctx context.Context, g *errgroup.Group, configuration *types.Configurat
 		})
 	}
 
+	sshTarget, _ := sshForward(configuration, sshPort)
 	for i := 0; i < len(forwardSocket); i++ {
 		var (
 			src *url.URL
@@ -445,7 +527,7 @@ func run(ctx context.Context, g *errgroup.Group, configuration *types.Configurat
 		dest := &url.URL{
 			Scheme: "ssh",
 			User:   url.User(forwardUser[i]),
-			Host:   sshHostPort,
+			Host:   sshTarget,
 			Path:   forwardDest[i],
 		}
 		j := i
@@ -117,3 +117,102 @@ func (c *Client) AddDNS(req *types.Zone) error {
 	}
 	return nil
 }
+
+// RemoveDNS removes the zone with the name of req.
+func (c *Client) RemoveDNS(req *types.Zone) error {
+	return c.post("/services/dns/remove", req)
+}
+
+// ReplaceDNS replaces the records and the default IP of the zone, or adds the zone.
+func (c *Client) ReplaceDNS(req *types.Zone) error {
+	return c.post("/services/dns/replace", req)
+}
+
+// RemoveDNSRecords removes the records of the zone with the same name and type as the records of req.
+// Records without value remove all the records of their name.
+func (c *Client) RemoveDNSRecords(req *types.Zone) error {
+	return c.post("/services/dns/remove-records", req)
+}
+
+// ReplaceDNSRecords replaces the records of the zone with the same name and type as the records of req.
+func (c *Client) ReplaceDNSRecords(req *types.Zone) error {
+	return c.post("/services/dns/replace-records", req)
+}
+
+func (c *Client) ListNAT() ([]types.NATRequest, error) {
+	res, err := c.client.Get(fmt.Sprintf("%s%s", c.base, "/services/nat/all"))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+	var translations []types.NATRequest
+	if err := json.NewDecoder(res.Body).Decode(&translations); err != nil {
+		return nil, err
+	}
+	return translations, nil
+}
+
+// AddNAT translates the traffic sent to req.VirtualIP to req.HostIP, replacing any previous translation.
+// The gateway answers to the ARP requests about the virtual IP.
+func (c *Client) AddNAT(req *types.NATRequest) error {
+	return c.post("/services/nat/add", req)
+}
+
+// RemoveNAT removes the translation of req.VirtualIP.
+func (c *Client) RemoveNAT(req *types.NATRequest) error {
+	return c.post("/services/nat/remove", req)
+}
+
+func (c *Client) ListFirewall() (*types.Firewall, error) {
+	res, err := c.client.Get(fmt.Sprintf("%s%s", c.base, "/services/firewall/all"))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+	var policy types.Firewall
+	if err := json.NewDecoder(res.Body).Decode(&policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// SetFirewall replaces the default action and all the rules of the firewall.
+func (c *Client) SetFirewall(req *types.Firewall) error {
+	return c.post("/services/firewall/set", req)
+}
+
+// AddFirewallRule appends the rule to the rules of the firewall.
+func (c *Client) AddFirewallRule(req *types.FirewallRule) error {
+	return c.post("/services/firewall/add", req)
+}
+
+// RemoveFirewallRule removes the rules of the firewall identical to req.
+func (c *Client) RemoveFirewallRule(req *types.FirewallRule) error {
+	return c.post("/services/firewall/remove", req)
+}
+
+func (c *Client) post(path string, req interface{}) error {
+	bin, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Post(fmt.Sprintf("%s%s", c.base, path), "application/json", bytes.NewReader(bin))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err, readErr := io.ReadAll(res.Body)
+		if readErr != nil {
+			return fmt.Errorf("error while reading error message: %v", readErr)
+		}
+		return errors.New(strings.TrimSpace(string(err)))
+	}
+	return nil
+}
@@ -3,9 +3,10 @@ package dhcp
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
-	"time"
+	"strings"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/tap"
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
@@ -23,54 +24,138 @@ import (
 
 const serverPort = 67
 
-func handler(configuration *types.Configuration, ipPool *tap.IPPool) server4.Handler {
+func handler(configuration *types.Configuration, ipPool *tap.IPPool, opts *options) server4.Handler {
 	return func(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
-		reply, err := dhcpv4.NewReplyFromRequest(m)
-		if err != nil {
-			log.Errorf("dhcp: cannot build reply from request: %v", err)
+		gatewayIP := net.ParseIP(configuration.GatewayIP)
+		if serverID := m.ServerIdentifier(); serverID != nil && !serverID.Equal(gatewayIP) {
+			// message for another server
 			return
 		}
 
-		ip, err := ipPool.GetOrAssign(m.ClientHWAddr.String())
-		if err != nil {
-			log.Errorf("dhcp: cannot assign ip: %v", err)
-			return
-		}
-
-		_, parsedSubnet, err := net.ParseCIDR(configuration.Subnet)
+		reply, err := dhcpv4.NewReplyFromRequest(m)
 		if err != nil {
-			log.Errorf("dhcp: invalid subnet %v", err)
+			log.Errorf("dhcp: cannot build reply from request: %v", err)
 			return
 		}
+		reply.UpdateOption(dhcpv4.OptServerIdentifier(gatewayIP))
 
-		reply.YourIPAddr = ip
-		reply.UpdateOption(dhcpv4.OptServerIdentifier(net.ParseIP(configuration.GatewayIP)))
-		reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(time.Hour))
-
-		reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionSubnetMask, Value: dhcpv4.IP(parsedSubnet.Mask)})
-		reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRouter, Value: dhcpv4.IP(net.ParseIP(configuration.GatewayIP))})
-		reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionDomainNameServer, Value: dhcpv4.IPs([]net.IP{net.ParseIP(configuration.GatewayIP)})})
-		reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionInterfaceMTU, Value: dhcpv4.Uint16(configuration.MTU)})
-		reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionDNSDomainSearchList, Value: &rfc1035label.Labels{
-			Labels: configuration.DNSSearchDomains,
-		}})
-
+		mac := m.ClientHWAddr.String()
 		switch mt := m.MessageType(); mt {
 		case dhcpv4.MessageTypeDiscover:
+			ip, err := ipPool.GetOrAssign(mac)
+			if err != nil {
+				log.Errorf("dhcp: cannot assign ip: %v", err)
+				return
+			}
+			reply.YourIPAddr = ip
+			reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(ipPool.LeaseTime()))
 			reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
 		case dhcpv4.MessageTypeRequest:
+			requested := m.RequestedIPAddress()
+			if requested == nil || requested.IsUnspecified() {
+				// renewing or rebinding clients only fill ciaddr
+				requested = m.ClientIPAddr
+			}
+			ip, err := ipPool.Request(mac, requested)
+			if errors.Is(err, tap.ErrNotLeased) {
+				// the client asks for an address leased to another client, or it already has another lease
+				log.Debugf("dhcp: %s requested %s which can't be leased to it", mac, requested)
+				reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+				break
+			}
+			if err != nil {
+				log.Errorf("dhcp: cannot assign ip: %v", err)
+				return
+			}
+			reply.YourIPAddr = ip
+			reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(ipPool.LeaseTime()))
+			reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+			if hostname := clientHostname(m); hostname != "" {
+				ipPool.SetHostname(mac, hostname)
+			}
+		case dhcpv4.MessageTypeRelease:
+			ipPool.ReleaseAddress(mac, m.ClientIPAddr)
+			return
+		case dhcpv4.MessageTypeDecline:
+			if requested := m.RequestedIPAddress(); requested != nil {
+				log.Warnf("dhcp: %s declined %s, the address is already in use", mac, requested)
+				ipPool.Decline(mac, requested)
+			}
+			return
+		case dhcpv4.MessageTypeInform:
+			// the client already has an address, only send the configuration without lease (RFC 2131 section 3.4)
 			reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
 		default:
 			log.Errorf("dhcp: unhandled message type: %v", mt)
 			return
 		}
 
+		if reply.MessageType() != dhcpv4.MessageTypeNak {
+			if err := addOptions(configuration, reply); err != nil {
+				log.Errorf("dhcp: %v", err)
+				return
+			}
+			opts.apply(reply, mac)
+		}
+
 		if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
 			log.Errorf("dhcp: cannot reply to client: %v", err)
 		}
 	}
 }
 
+// clientHostname returns the hostname sent by the client with the FQDN option (81), or else the host name option (12).
+// Only the first label is kept, and an empty string is returned when it is not a valid DNS label.
+func clientHostname(m *dhcpv4.DHCPv4) string {
+	var hostname string
+	if fqdn := m.Options.Get(dhcpv4.OptionFQDN); len(fqdn) > 3 {
+		// flags, 2 deprecated RCODE fields then the name (RFC 4702 section 2)
+		flags, name := fqdn[0], fqdn[3:]
+		if flags&0x04 != 0 {
+			// canonical wire format
+			if int(name[0]) < len(name) {
+				hostname = string(name[1 : 1+int(name[0])])
+			}
+		} else {
+			hostname = strings.SplitN(string(name), ".", 2)[0]
+		}
+	}
+	if hostname == "" {
+		hostname = strings.SplitN(m.HostName(), ".", 2)[0]
+	}
+
+	hostname = strings.ToLower(hostname)
+	if len(hostname) > 63 || strings.HasPrefix(hostname, "-") || strings.HasSuffix(hostname, "-") {
+		return ""
+	}
+	for _, c := range hostname {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return ""
+		}
+	}
+	return hostname
+}
+
+// addOptions sets the network configuration of the virtual machine in the reply.
+func addOptions(configuration *types.Configuration, reply *dhcpv4.DHCPv4) error {
+	_, parsedSubnet, err := net.ParseCIDR(configuration.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %v", err)
+	}
+
+	reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionSubnetMask, Value: dhcpv4.IP(parsedSubnet.Mask)})
+	reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRouter, Value: dhcpv4.IP(net.ParseIP(configuration.GatewayIP))})
+	reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionDomainNameServer, Value: dhcpv4.IPs([]net.IP{net.ParseIP(configuration.GatewayIP)})})
+	if configuration.NTP {
+		reply.UpdateOption(dhcpv4.OptNTPServers(net.ParseIP(configuration.GatewayIP)))
+	}
+	reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionInterfaceMTU, Value: dhcpv4.Uint16(configuration.MTU)})
+	reply.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionDNSDomainSearchList, Value: &rfc1035label.Labels{
+		Labels: configuration.DNSSearchDomains,
+	}})
+	return nil
+}
+
 func dial(s *stack.Stack, nic int) (*gonet.UDPConn, error) {
 	var wq waiter.Queue
 	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
@@ -98,12 +183,17 @@ type Server struct {
 }
 
 func New(configuration *types.Configuration, stack *stack.Stack, ipPool *tap.IPPool) (*Server, error) {
+	opts, err := newOptions(configuration)
+	if err != nil {
+		return nil, err
+	}
+
 	ln, err := dial(stack, 1)
 	if err != nil {
 		return nil, err
 	}
 
-	s, err := server4.NewServer("", nil, handler(configuration, ipPool), server4.WithConn(ln))
+	s, err := server4.NewServer("", nil, handler(configuration, ipPool, opts), server4.WithConn(ln))
 	if err != nil {
 		return nil, err
 	}
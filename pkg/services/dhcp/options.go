@@ -0,0 +1,152 @@
+package dhcp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// options are the DHCP options of the configuration, ready to be added to the replies.
+type options struct {
+	network []dhcpv4.Modifier
+	// indexed by MAC address
+	hosts map[string][]dhcpv4.Modifier
+}
+
+func newOptions(configuration *types.Configuration) (*options, error) {
+	opts := &options{
+		hosts: make(map[string][]dhcpv4.Modifier),
+	}
+	if configuration.DHCPOptions != nil {
+		network, err := parseOptions(configuration, *configuration.DHCPOptions)
+		if err != nil {
+			return nil, err
+		}
+		opts.network = network
+	}
+	for mac, hostOptions := range configuration.DHCPHostOptions {
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, err
+		}
+		host, err := parseOptions(configuration, hostOptions)
+		if err != nil {
+			return nil, fmt.Errorf("options of %s: %w", mac, err)
+		}
+		opts.hosts[hwAddr.String()] = host
+	}
+	return opts, nil
+}
+
+// apply adds the options of the network, then the ones of the host, to the reply.
+func (o *options) apply(reply *dhcpv4.DHCPv4, mac string) {
+	for _, modifier := range o.network {
+		modifier(reply)
+	}
+	for _, modifier := range o.hosts[mac] {
+		modifier(reply)
+	}
+}
+
+func parseOptions(configuration *types.Configuration, config types.DHCPOptions) ([]dhcpv4.Modifier, error) {
+	var opts []dhcpv4.Modifier
+	if len(config.NTPServers) > 0 {
+		var servers []net.IP
+		for _, server := range config.NTPServers {
+			ip := net.ParseIP(server)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("invalid NTP server %q", server)
+			}
+			servers = append(servers, ip)
+		}
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptNTPServers(servers...)))
+	}
+	if config.Hostname != "" {
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptHostName(config.Hostname)))
+	}
+	if config.DomainName != "" {
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptDomainName(config.DomainName)))
+	}
+	if len(config.Routes) > 0 {
+		routes, err := parseRoutes(configuration, config.Routes)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptClasslessStaticRoute(routes...)))
+	}
+	if config.VendorSpecific != "" {
+		value, err := hex.DecodeString(config.VendorSpecific)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vendor specific information: %w", err)
+		}
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, value)))
+	}
+	if config.BootFile != "" {
+		opts = append(opts, bootModifiers(configuration, config)...)
+	}
+	for code, raw := range config.Raw {
+		switch code {
+		case dhcpv4.OptionPad.Code(), dhcpv4.OptionEnd.Code(), dhcpv4.OptionDHCPMessageType.Code(), dhcpv4.OptionServerIdentifier.Code():
+			return nil, fmt.Errorf("option %d can't be set", code)
+		}
+		value, err := hex.DecodeString(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of option %d: %w", code, err)
+		}
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(code), value)))
+	}
+	return opts, nil
+}
+
+func parseRoutes(configuration *types.Configuration, config []types.Route) ([]*dhcpv4.Route, error) {
+	gateway := net.ParseIP(configuration.GatewayIP)
+	var routes []*dhcpv4.Route
+	hasDefault := false
+	for _, route := range config {
+		_, destination, err := net.ParseCIDR(route.Destination)
+		if err != nil || destination.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid route destination %q", route.Destination)
+		}
+		router := gateway
+		if route.Gateway != "" {
+			router = net.ParseIP(route.Gateway)
+			if router == nil || router.To4() == nil {
+				return nil, fmt.Errorf("invalid route gateway %q", route.Gateway)
+			}
+		}
+		if ones, _ := destination.Mask.Size(); ones == 0 {
+			hasDefault = true
+		}
+		routes = append(routes, &dhcpv4.Route{Dest: destination, Router: router})
+	}
+	if !hasDefault {
+		routes = append(routes, &dhcpv4.Route{
+			Dest:   &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			Router: gateway,
+		})
+	}
+	return routes, nil
+}
+
+// bootModifiers sets the TFTP server and the boot file used by PXE clients, both in the header and
+// in the options 66 and 67 since clients use either of them. The TFTP server defaults to the gateway.
+func bootModifiers(configuration *types.Configuration, config types.DHCPOptions) []dhcpv4.Modifier {
+	server := config.TFTPServer
+	if server == "" {
+		server = configuration.GatewayIP
+	}
+	modifiers := []dhcpv4.Modifier{
+		func(d *dhcpv4.DHCPv4) {
+			d.BootFileName = config.BootFile
+		},
+		dhcpv4.WithOption(dhcpv4.OptTFTPServerName(server)),
+		dhcpv4.WithOption(dhcpv4.OptBootFileName(config.BootFile)),
+	}
+	if ip := net.ParseIP(server); ip != nil && ip.To4() != nil {
+		modifiers = append(modifiers, dhcpv4.WithServerIP(ip))
+	}
+	return modifiers
+}
@@ -0,0 +1,104 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	configuration := &types.Configuration{
+		GatewayIP: "192.168.127.1",
+		DHCPOptions: &types.DHCPOptions{
+			NTPServers: []string{"192.168.127.1"},
+			DomainName: "containers.internal",
+			Routes: []types.Route{
+				{Destination: "10.88.0.0/16", Gateway: "192.168.127.254"},
+			},
+			Raw: map[uint8]string{252: "68747470"},
+		},
+		DHCPHostOptions: map[string]types.DHCPOptions{
+			"5A:94:EF:E4:0C:EE": {
+				Hostname:   "fedora",
+				DomainName: "vm.containers.internal",
+			},
+		},
+	}
+	opts, err := newOptions(configuration)
+	assert.NoError(t, err)
+
+	reply, err := dhcpv4.New()
+	assert.NoError(t, err)
+	opts.apply(reply, "5a:94:ef:e4:0c:ee")
+
+	assert.Equal(t, "fedora", reply.HostName())
+	assert.Equal(t, "vm.containers.internal", reply.DomainName())
+	assert.Equal(t, []byte("http"), reply.Options.Get(dhcpv4.GenericOptionCode(252)))
+	assert.Equal(t, []net.IP{net.ParseIP("192.168.127.1").To4()}, reply.NTPServers())
+	routes := reply.ClasslessStaticRoute()
+	assert.Len(t, routes, 2)
+	assert.Equal(t, "10.88.0.0/16", routes[0].Dest.String())
+	assert.Equal(t, "192.168.127.254", routes[0].Router.String())
+	// clients ignore the router option with classless routes
+	assert.Equal(t, "0.0.0.0/0", routes[1].Dest.String())
+	assert.Equal(t, "192.168.127.1", routes[1].Router.String())
+
+	reply, err = dhcpv4.New()
+	assert.NoError(t, err)
+	opts.apply(reply, "5a:94:ef:e4:0c:ff")
+	assert.Equal(t, "", reply.HostName())
+	assert.Equal(t, "containers.internal", reply.DomainName())
+}
+
+func TestInvalidOptions(t *testing.T) {
+	_, err := newOptions(&types.Configuration{
+		DHCPOptions: &types.DHCPOptions{Raw: map[uint8]string{53: "01"}},
+	})
+	assert.Error(t, err)
+
+	_, err = newOptions(&types.Configuration{
+		DHCPOptions: &types.DHCPOptions{Routes: []types.Route{{Destination: "10.88.0.0"}}},
+	})
+	assert.Error(t, err)
+}
+
+func TestBootOptions(t *testing.T) {
+	opts, err := newOptions(&types.Configuration{
+		GatewayIP: "192.168.127.1",
+		DHCPOptions: &types.DHCPOptions{
+			BootFile: "undionly.kpxe",
+		},
+	})
+	assert.NoError(t, err)
+
+	reply, err := dhcpv4.New()
+	assert.NoError(t, err)
+	opts.apply(reply, "5a:94:ef:e4:0c:ee")
+
+	assert.Equal(t, "undionly.kpxe", reply.BootFileName)
+	assert.Equal(t, "undionly.kpxe", reply.BootFileNameOption())
+	assert.Equal(t, "192.168.127.1", reply.ServerIPAddr.String())
+	assert.Equal(t, "192.168.127.1", reply.TFTPServerName())
+}
+
+func TestNTPOption(t *testing.T) {
+	configuration := &types.Configuration{
+		Subnet:    "192.168.127.0/24",
+		GatewayIP: "192.168.127.1",
+		MTU:       1500,
+		NTP:       true,
+	}
+	reply, err := dhcpv4.New()
+	assert.NoError(t, err)
+	assert.NoError(t, addOptions(configuration, reply))
+	assert.Equal(t, []net.IP{net.ParseIP("192.168.127.1").To4()}, reply.NTPServers())
+
+	configuration.NTP = false
+	reply, err = dhcpv4.New()
+	assert.NoError(t, err)
+	assert.NoError(t, addOptions(configuration, reply))
+	assert.Empty(t, reply.NTPServers())
+}
@@ -0,0 +1,277 @@
+package dhcpv6
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+func handler(configuration *types.Configuration, ipPool *tap.IPPool, serverID dhcpv6.Duid, resolve func(net.IP) (net.HardwareAddr, bool)) server6.Handler {
+	return func(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+		msg, err := m.GetInnerMessage()
+		if err != nil {
+			log.Errorf("dhcpv6: cannot decode message: %v", err)
+			return
+		}
+
+		clientID := msg.Options.ClientID()
+		if clientID == nil {
+			log.Errorf("dhcpv6: message without client identifier")
+			return
+		}
+		if id := msg.Options.ServerID(); id != nil && !id.Equal(serverID) {
+			// message for another server
+			return
+		}
+		link := clientLinkAddress(m, peer, clientID, resolve)
+
+		modifiers := []dhcpv6.Modifier{
+			dhcpv6.WithServerID(serverID),
+			dhcpv6.WithDNS(net.ParseIP(configuration.IPv6GatewayIP)),
+		}
+		if len(configuration.DNSSearchDomains) > 0 {
+			modifiers = append(modifiers, dhcpv6.WithDomainSearchList(configuration.DNSSearchDomains...))
+		}
+
+		var reply *dhcpv6.Message
+		var address *dhcpv6.OptIANA
+		switch mt := msg.Type(); mt {
+		case dhcpv6.MessageTypeSolicit:
+			if !configuration.DHCPv6Stateful {
+				// Addresses are autoconfigured with SLAAC, only answer to information requests
+				return
+			}
+			address, err = assign(ipPool, clientID, link, mt, msg.Options.OneIANA())
+			if err != nil {
+				log.Errorf("dhcpv6: cannot assign ip: %v", err)
+				return
+			}
+			modifiers = append(modifiers, dhcpv6.WithOption(address))
+			if msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
+				reply, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+			} else {
+				reply, err = dhcpv6.NewAdvertiseFromSolicit(msg, modifiers...)
+			}
+		case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+			if !configuration.DHCPv6Stateful {
+				return
+			}
+			address, err = assign(ipPool, clientID, link, mt, msg.Options.OneIANA())
+			if err != nil {
+				log.Errorf("dhcpv6: cannot assign ip: %v", err)
+				return
+			}
+			modifiers = append(modifiers, dhcpv6.WithOption(address))
+			reply, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+		case dhcpv6.MessageTypeRelease:
+			for _, ia := range msg.Options.IANA() {
+				for _, address := range ia.Options.Addresses() {
+					ipPool.ReleaseAddress(leaseKey(clientID), address.IPv6Addr)
+				}
+			}
+			modifiers = append(modifiers, dhcpv6.WithOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess}))
+			reply, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+		case dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeInformationRequest:
+			reply, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+		default:
+			log.Errorf("dhcpv6: unhandled message type: %v", mt)
+			return
+		}
+		if err != nil {
+			log.Errorf("dhcpv6: cannot build reply: %v", err)
+			return
+		}
+
+		response := dhcpv6.DHCPv6(reply)
+		if relay, ok := m.(*dhcpv6.RelayMessage); ok {
+			// the reply goes back through the same relay agents (RFC 8415 section 19.3)
+			response, err = dhcpv6.NewRelayReplFromRelayForw(relay, reply)
+			if err != nil {
+				log.Errorf("dhcpv6: cannot build relay reply: %v", err)
+				return
+			}
+		}
+
+		if _, err := conn.WriteTo(response.ToBytes(), peer); err != nil {
+			log.Errorf("dhcpv6: cannot reply to client: %v", err)
+		}
+	}
+}
+
+// assign returns the IA_NA option holding the address leased to the client, and records its MAC address if known.
+// The address asked by the client is leased when it is available, otherwise the client gets its own address.
+// Renew only extends the existing lease, and Rebind only the lease of the address asked (RFC 8415 section 18.3).
+func assign(ipPool *tap.IPPool, clientID *dhcpv6.Duid, link net.HardwareAddr, mt dhcpv6.MessageType, requested *dhcpv6.OptIANA) (*dhcpv6.OptIANA, error) {
+	key := leaseKey(clientID)
+	option := &dhcpv6.OptIANA{}
+	var asked net.IP
+	if requested != nil {
+		option.IaId = requested.IaId
+		if address := requested.Options.OneAddress(); address != nil {
+			asked = address.IPv6Addr
+		}
+	}
+
+	var ip net.IP
+	var err error
+	switch mt {
+	case dhcpv6.MessageTypeRenew:
+		if leased, ok := ipPool.Lookup(key); !ok || (asked != nil && !asked.Equal(leased)) {
+			option.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoBinding})
+			return option, nil
+		}
+		ip, err = ipPool.GetOrAssign(key)
+	case dhcpv6.MessageTypeRebind:
+		ip, err = ipPool.Request(key, asked)
+		if errors.Is(err, tap.ErrNotLeased) {
+			// the address can't be used anymore, zero lifetimes tell it to the client
+			option.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: asked})
+			return option, nil
+		}
+	default:
+		ip, err = ipPool.Request(key, asked)
+		if errors.Is(err, tap.ErrNotLeased) {
+			ip, err = ipPool.GetOrAssign(key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if link != nil {
+		ipPool.SetLinkAddress(key, link.String())
+	}
+
+	leaseTime := ipPool.LeaseTime()
+	option.T1 = leaseTime / 2
+	option.T2 = leaseTime * 7 / 8
+	option.Options.Add(&dhcpv6.OptIAAddress{
+		IPv6Addr:          ip,
+		PreferredLifetime: leaseTime,
+		ValidLifetime:     leaseTime,
+	})
+	return option, nil
+}
+
+// clientLinkAddress returns the MAC address of the client, given by resolve for the address of a client talking directly
+// to the server, or else by its DUID. It is nil when unknown, e.g. with a DUID-EN and without port security.
+func clientLinkAddress(m dhcpv6.DHCPv6, peer net.Addr, clientID *dhcpv6.Duid, resolve func(net.IP) (net.HardwareAddr, bool)) net.HardwareAddr {
+	if addr, ok := peer.(*net.UDPAddr); ok && !m.IsRelay() && resolve != nil {
+		if mac, ok := resolve(addr.IP); ok {
+			return mac
+		}
+	}
+	if (clientID.Type == dhcpv6.DUID_LL || clientID.Type == dhcpv6.DUID_LLT) && len(clientID.LinkLayerAddr) > 0 {
+		return clientID.LinkLayerAddr
+	}
+	return nil
+}
+
+// leaseKey identifies the client in the IP pool.
+// The MAC address is used when the DUID contains it so that DHCP and DHCPv6 leases of a VM look alike.
+func leaseKey(clientID *dhcpv6.Duid) string {
+	if (clientID.Type == dhcpv6.DUID_LL || clientID.Type == dhcpv6.DUID_LLT) && len(clientID.LinkLayerAddr) > 0 {
+		return clientID.LinkLayerAddr.String()
+	}
+	return clientID.String()
+}
+
+func dial(s *stack.Stack, nic int) (*gonet.UDPConn, error) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	ep.SocketOptions().SetV6Only(true)
+
+	if err := ep.Bind(tcpip.FullAddress{
+		NIC:  tcpip.NICID(nic),
+		Addr: tcpip.Address{},
+		Port: uint16(dhcpv6.DefaultServerPort),
+	}); err != nil {
+		ep.Close()
+		return nil, errors.New(err.String())
+	}
+
+	if err := ep.SetSockOpt(&tcpip.AddMembershipOption{
+		NIC:           tcpip.NICID(nic),
+		MulticastAddr: tcpip.AddrFrom16Slice(dhcpv6.AllDHCPRelayAgentsAndServers),
+	}); err != nil {
+		ep.Close()
+		return nil, errors.New(err.String())
+	}
+
+	return gonet.NewUDPConn(s, &wq, ep), nil
+}
+
+type Server struct {
+	Underlying *server6.Server
+	IPPool     *tap.IPPool
+
+	resolve func(net.IP) (net.HardwareAddr, bool)
+}
+
+func New(configuration *types.Configuration, stack *stack.Stack, ipPool *tap.IPPool) (*Server, error) {
+	gatewayMac, err := net.ParseMAC(configuration.GatewayMacAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := dial(stack, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	serverID := dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: gatewayMac,
+	}
+	server := &Server{
+		IPPool: ipPool,
+	}
+	server.Underlying, err = server6.NewServer("", nil, handler(configuration, ipPool, serverID, server.linkAddress), server6.WithConn(ln))
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// SetLinkAddressResolver gives the MAC addresses of the clients from their link-local address, like the port security
+// of the switch does. It must be called before Serve.
+func (s *Server) SetLinkAddressResolver(resolve func(ip net.IP) (net.HardwareAddr, bool)) {
+	s.resolve = resolve
+}
+
+func (s *Server) linkAddress(ip net.IP) (net.HardwareAddr, bool) {
+	if s.resolve == nil {
+		return nil, false
+	}
+	return s.resolve(ip)
+}
+
+func (s *Server) Serve() error {
+	return s.Underlying.Serve()
+}
+
+func (s *Server) Mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/leases", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(s.IPPool.Leases())
+	})
+	return mux
+}
@@ -0,0 +1,167 @@
+package dhcpv6
+
+import (
+	"net"
+	"testing"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+)
+
+// replies records the messages sent by the handler.
+type replies struct {
+	net.PacketConn
+	sent []dhcpv6.DHCPv6
+}
+
+func (r *replies) WriteTo(b []byte, _ net.Addr) (int, error) {
+	m, err := dhcpv6.FromBytes(b)
+	if err != nil {
+		return 0, err
+	}
+	r.sent = append(r.sent, m)
+	return len(b), nil
+}
+
+func testHandler(t *testing.T, resolve func(net.IP) (net.HardwareAddr, bool)) (func(dhcpv6.DHCPv6) dhcpv6.DHCPv6, *tap.IPPool) {
+	_, subnet, _ := net.ParseCIDR("fd00::/64")
+	ipPool := tap.NewIPPool(subnet)
+	ipPool.Reserve(net.ParseIP("fd00::1"), "5a:94:ef:e4:0c:dd")
+	serverID := dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xdd},
+	}
+	h := handler(&types.Configuration{
+		IPv6GatewayIP:  "fd00::1",
+		DHCPv6Stateful: true,
+	}, ipPool, serverID, resolve)
+
+	return func(m dhcpv6.DHCPv6) dhcpv6.DHCPv6 {
+		conn := &replies{}
+		h(conn, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultClientPort}, m)
+		if !assert.Len(t, conn.sent, 1) {
+			t.FailNow()
+		}
+		return conn.sent[0]
+	}, ipPool
+}
+
+func leasedAddress(t *testing.T, m *dhcpv6.Message) net.IP {
+	ia := m.Options.OneIANA()
+	if !assert.NotNil(t, ia) {
+		t.FailNow()
+	}
+	address := ia.Options.OneAddress()
+	if !assert.NotNil(t, address) {
+		t.FailNow()
+	}
+	return address.IPv6Addr
+}
+
+func TestSolicitRequest(t *testing.T) {
+	exchange, ipPool := testHandler(t, nil)
+	mac := net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xee}
+
+	solicit, err := dhcpv6.NewSolicit(mac)
+	assert.NoError(t, err)
+	advertise, ok := exchange(solicit).(*dhcpv6.Message)
+	assert.True(t, ok)
+	assert.Equal(t, dhcpv6.MessageTypeAdvertise, advertise.Type())
+	assert.Equal(t, solicit.TransactionID, advertise.TransactionID)
+	assert.Equal(t, "fd00::2", leasedAddress(t, advertise).String())
+	assert.Equal(t, []net.IP{net.ParseIP("fd00::1")}, advertise.Options.DNS())
+
+	request, err := dhcpv6.NewRequestFromAdvertise(advertise)
+	assert.NoError(t, err)
+	reply, ok := exchange(request).(*dhcpv6.Message)
+	assert.True(t, ok)
+	assert.Equal(t, dhcpv6.MessageTypeReply, reply.Type())
+	assert.Equal(t, "fd00::2", leasedAddress(t, reply).String())
+	assert.Equal(t, map[string]string{"fd00::1": "5a:94:ef:e4:0c:dd", "fd00::2": mac.String()}, ipPool.Leases())
+}
+
+func TestRelayedSolicit(t *testing.T) {
+	exchange, _ := testHandler(t, nil)
+
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xee})
+	assert.NoError(t, err)
+	relayed, err := dhcpv6.EncapsulateRelay(solicit, dhcpv6.MessageTypeRelayForward, net.ParseIP("fd00::"), net.ParseIP("fe80::2"))
+	assert.NoError(t, err)
+
+	relayReply, ok := exchange(relayed).(*dhcpv6.RelayMessage)
+	assert.True(t, ok)
+	assert.Equal(t, dhcpv6.MessageTypeRelayReply, relayReply.Type())
+	assert.Equal(t, "fe80::2", relayReply.PeerAddr.String())
+	advertise, err := relayReply.GetInnerMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, dhcpv6.MessageTypeAdvertise, advertise.Type())
+	assert.Equal(t, "fd00::2", leasedAddress(t, advertise).String())
+}
+
+func TestLinkAddress(t *testing.T) {
+	mac := net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xee}
+	exchange, ipPool := testHandler(t, func(ip net.IP) (net.HardwareAddr, bool) {
+		return mac, ip.Equal(net.ParseIP("fe80::1"))
+	})
+
+	// DUID-EN, used by systemd-networkd, doesn't hold the MAC address
+	solicit, err := dhcpv6.NewSolicit(mac, dhcpv6.WithClientID(dhcpv6.Duid{
+		Type:                 dhcpv6.DUID_EN,
+		EnterpriseNumber:     43793,
+		EnterpriseIdentifier: []byte{0x01, 0x02},
+	}))
+	assert.NoError(t, err)
+	advertise, ok := exchange(solicit).(*dhcpv6.Message)
+	assert.True(t, ok)
+
+	assert.Contains(t, ipPool.Leases()[leasedAddress(t, advertise).String()], "DUID-EN")
+	owner, ok := ipPool.LinkAddress(leasedAddress(t, advertise))
+	assert.True(t, ok)
+	assert.Equal(t, mac.String(), owner)
+}
+
+func clientMessage(t *testing.T, mt dhcpv6.MessageType, mac net.HardwareAddr, asked string) *dhcpv6.Message {
+	m, err := dhcpv6.NewMessage(
+		dhcpv6.WithClientID(dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: mac}),
+		dhcpv6.WithIANA(dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP(asked)}),
+	)
+	assert.NoError(t, err)
+	m.MessageType = mt
+	return m
+}
+
+func TestRequestedAddress(t *testing.T) {
+	exchange, _ := testHandler(t, nil)
+	mac1 := net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xee}
+	mac2 := net.HardwareAddr{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xef}
+
+	// an available address is granted
+	reply := exchange(clientMessage(t, dhcpv6.MessageTypeRequest, mac1, "fd00::10")).(*dhcpv6.Message)
+	assert.Equal(t, "fd00::10", leasedAddress(t, reply).String())
+
+	// renewals keep it
+	reply = exchange(clientMessage(t, dhcpv6.MessageTypeRenew, mac1, "fd00::10")).(*dhcpv6.Message)
+	assert.Equal(t, "fd00::10", leasedAddress(t, reply).String())
+	assert.Nil(t, reply.Options.OneIANA().Options.Status())
+
+	// no binding for another address, or for a client without lease
+	reply = exchange(clientMessage(t, dhcpv6.MessageTypeRenew, mac1, "fd00::11")).(*dhcpv6.Message)
+	assert.Equal(t, iana.StatusNoBinding, reply.Options.OneIANA().Options.Status().StatusCode)
+	assert.Empty(t, reply.Options.OneIANA().Options.Addresses())
+	reply = exchange(clientMessage(t, dhcpv6.MessageTypeRenew, mac2, "fd00::11")).(*dhcpv6.Message)
+	assert.Equal(t, iana.StatusNoBinding, reply.Options.OneIANA().Options.Status().StatusCode)
+
+	// the address of another client can't be rebound
+	reply = exchange(clientMessage(t, dhcpv6.MessageTypeRebind, mac2, "fd00::10")).(*dhcpv6.Message)
+	address := reply.Options.OneIANA().Options.OneAddress()
+	assert.Equal(t, "fd00::10", address.IPv6Addr.String())
+	assert.Zero(t, address.ValidLifetime)
+
+	// and it is not given on request
+	reply = exchange(clientMessage(t, dhcpv6.MessageTypeRequest, mac2, "fd00::10")).(*dhcpv6.Message)
+	assert.Equal(t, "fd00::2", leasedAddress(t, reply).String())
+}
@@ -3,6 +3,7 @@ package dns
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,16 +15,43 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// maxAliases bounds the chains of CNAME records followed by Lookup
+const maxAliases = 8
+
+// ResolutionRecorder is notified of the addresses resolved by the virtual machines. It is implemented by Resolutions.
+type ResolutionRecorder interface {
+	RecordResolution(name string, ip net.IP, ttl uint32)
+}
+
 type dnsHandler struct {
 	zones     []types.Zone
 	zonesLock sync.RWMutex
+
+	// nil when names are resolved with the resolver of the host
+	upstream *upstream
+	// forward requests for names outside of the zones to the upstream nameservers as is
+	passthrough bool
+
+	// the reverse zones of these networks are answered locally
+	subnets []*net.IPNet
+	leases  []LeaseSource
+	// zone of the hostnames sent by the DHCP clients, disabled when empty
+	hostnameZone string
+
+	recorders []ResolutionRecorder
 }
 
 func (h *dnsHandler) handle(w dns.ResponseWriter, r *dns.Msg, responseMessageSize int) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.RecursionAvailable = true
-	h.addAnswers(m)
+	var m *dns.Msg
+	if h.passthrough && !h.inZones(r) {
+		m = h.forward(r)
+	} else {
+		m = new(dns.Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		h.addAnswers(m)
+	}
+	h.recordResolutions(m)
 	edns0 := r.IsEdns0()
 	if edns0 != nil {
 		responseMessageSize = int(edns0.UDPSize())
@@ -34,6 +62,38 @@ func (h *dnsHandler) handle(w dns.ResponseWriter, r *dns.Msg, responseMessageSiz
 	}
 }
 
+// recordResolutions notifies the recorders of the addresses of the response.
+// They are recorded with the name of the question, and with the name of their record when it is an alias.
+func (h *dnsHandler) recordResolutions(m *dns.Msg) {
+	h.zonesLock.RLock()
+	defer h.zonesLock.RUnlock()
+	if len(h.recorders) == 0 {
+		return
+	}
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch answer := rr.(type) {
+		case *dns.A:
+			ip = answer.A
+		case *dns.AAAA:
+			ip = answer.AAAA
+		default:
+			continue
+		}
+		names := []string{rr.Header().Name}
+		for _, q := range m.Question {
+			if !strings.EqualFold(q.Name, rr.Header().Name) {
+				names = append(names, q.Name)
+			}
+		}
+		for _, recorder := range h.recorders {
+			for _, name := range names {
+				recorder.RecordResolution(name, ip, rr.Header().Ttl)
+			}
+		}
+	}
+}
+
 func (h *dnsHandler) handleTCP(w dns.ResponseWriter, r *dns.Msg) {
 	h.handle(w, r, dns.MaxMsgSize)
 }
@@ -42,42 +102,101 @@ func (h *dnsHandler) handleUDP(w dns.ResponseWriter, r *dns.Msg) {
 	h.handle(w, r, dns.MinMsgSize)
 }
 
+// inZones returns whether one of the questions is about a name of the built-in zones.
+func (h *dnsHandler) inZones(r *dns.Msg) bool {
+	h.zonesLock.RLock()
+	defer h.zonesLock.RUnlock()
+	for _, q := range r.Question {
+		for _, zone := range h.zones {
+			if strings.HasSuffix(q.Name, fmt.Sprintf(".%s", zone.Name)) {
+				return true
+			}
+		}
+		if h.hostnameZone != "" && strings.HasSuffix(strings.ToLower(q.Name), "."+h.hostnameZone) {
+			return true
+		}
+		if ip := reverseIP(q.Name); ip != nil && h.isVirtual(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward returns the response of the upstream nameservers, with its rcode, flags and all its sections.
+func (h *dnsHandler) forward(r *dns.Msg) *dns.Msg {
+	res, err := h.upstream.forward(r)
+	if err != nil {
+		log.Debugf("dns: cannot forward request: %v", err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		m.RecursionAvailable = true
+		return m
+	}
+	res.Id = r.Id
+	return res
+}
+
 func (h *dnsHandler) addAnswers(m *dns.Msg) {
 	h.zonesLock.RLock()
 	defer h.zonesLock.RUnlock()
 	for _, q := range m.Question {
+		if h.hostnameZone != "" && strings.HasSuffix(strings.ToLower(q.Name), "."+h.hostnameZone) {
+			hostname := strings.TrimSuffix(strings.ToLower(q.Name), "."+h.hostnameZone)
+			if ip := h.hostnameIP(hostname); ip != nil {
+				rr := recordAnswer(q.Name, types.Record{IP: ip})
+				if rr.Header().Rrtype == q.Qtype {
+					m.Answer = append(m.Answer, rr)
+				}
+				return
+			}
+			// not a DHCP client, the zone may also hold static records, otherwise the name must not reach the host
+			if !h.hasZone(h.hostnameZone) {
+				m.Rcode = dns.RcodeNameError
+				return
+			}
+		}
+
 		for _, zone := range h.zones {
 			zoneSuffix := fmt.Sprintf(".%s", zone.Name)
 			if strings.HasSuffix(q.Name, zoneSuffix) {
-				if q.Qtype != dns.TypeA {
+				withoutZone := strings.TrimSuffix(q.Name, zoneSuffix)
+				matched := false
+				for _, record := range zone.Records {
+					if (record.Name == "" || record.Name != withoutZone) &&
+						(record.Regexp == nil || !record.Regexp.MatchString(withoutZone)) {
+						continue
+					}
+					matched = true
+					rr := recordAnswer(q.Name, record)
+					if rr == nil {
+						continue
+					}
+					rrtype := rr.Header().Rrtype
+					if rrtype != q.Qtype && (rrtype != dns.TypeCNAME || len(m.Answer) > 0) {
+						continue
+					}
+					m.Answer = append(m.Answer, rr)
+					// TXT and SRV records can have several values, the first match wins for the others
+					if rrtype != dns.TypeTXT && rrtype != dns.TypeSRV {
+						break
+					}
+				}
+				if matched {
 					return
 				}
-				for _, record := range zone.Records {
-					withoutZone := strings.TrimSuffix(q.Name, zoneSuffix)
-					if (record.Name != "" && record.Name == withoutZone) ||
-						(record.Regexp != nil && record.Regexp.MatchString(withoutZone)) {
-						m.Answer = append(m.Answer, &dns.A{
-							Hdr: dns.RR_Header{
-								Name:   q.Name,
-								Rrtype: dns.TypeA,
-								Class:  dns.ClassINET,
-								Ttl:    0,
-							},
-							A: record.IP,
-						})
-						return
+				// names given to leased addresses by reverse lookups, resolvable to confirm them
+				if ip := h.leaseIP(withoutZone); ip != nil && zone.Name == h.zones[0].Name {
+					rr := recordAnswer(q.Name, types.Record{IP: ip})
+					if rr.Header().Rrtype == q.Qtype {
+						m.Answer = append(m.Answer, rr)
 					}
+					return
 				}
 				if !zone.DefaultIP.Equal(net.IP("")) {
-					m.Answer = append(m.Answer, &dns.A{
-						Hdr: dns.RR_Header{
-							Name:   q.Name,
-							Rrtype: dns.TypeA,
-							Class:  dns.ClassINET,
-							Ttl:    0,
-						},
-						A: zone.DefaultIP,
-					})
+					rr := recordAnswer(q.Name, types.Record{IP: zone.DefaultIP})
+					if rr.Header().Rrtype == q.Qtype {
+						m.Answer = append(m.Answer, rr)
+					}
 					return
 				}
 				m.Rcode = dns.RcodeNameError
@@ -85,6 +204,32 @@ func (h *dnsHandler) addAnswers(m *dns.Msg) {
 			}
 		}
 
+		// Reverse lookups of the virtual network must not reach the host, it doesn't know these addresses
+		if ip := reverseIP(q.Name); ip != nil && h.isVirtual(ip) {
+			name := h.reverseName(ip)
+			if name == "" {
+				m.Rcode = dns.RcodeNameError
+				return
+			}
+			if q.Qtype == dns.TypePTR {
+				m.Answer = append(m.Answer, recordAnswer(q.Name, types.Record{PTR: name}))
+			}
+			return
+		}
+
+		if h.upstream != nil {
+			res, err := h.upstream.resolve(q)
+			if err != nil {
+				log.Debugf("dns: cannot resolve %s: %v", q.Name, err)
+				m.Rcode = dns.RcodeServerFailure
+				return
+			}
+			m.Answer = append(m.Answer, res.Answer...)
+			m.Ns = append(m.Ns, res.Ns...)
+			m.Rcode = res.Rcode
+			continue
+		}
+
 		resolver := net.Resolver{
 			PreferGo: false,
 		}
@@ -198,6 +343,43 @@ func (h *dnsHandler) addAnswers(m *dns.Msg) {
 	}
 }
 
+// recordAnswer returns the resource record answering for name with the value of record.
+func recordAnswer(name string, record types.Record) dns.RR {
+	hdr := dns.RR_Header{
+		Name:  name,
+		Class: dns.ClassINET,
+		Ttl:   record.TTL,
+	}
+	switch record.Type() {
+	case "A":
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: record.IP.To4()}
+	case "AAAA":
+		hdr.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: hdr, AAAA: record.IP}
+	case "CNAME":
+		hdr.Rrtype = dns.TypeCNAME
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(record.CNAME)}
+	case "TXT":
+		hdr.Rrtype = dns.TypeTXT
+		return &dns.TXT{Hdr: hdr, Txt: record.TXT}
+	case "SRV":
+		hdr.Rrtype = dns.TypeSRV
+		return &dns.SRV{
+			Hdr:      hdr,
+			Priority: record.SRV.Priority,
+			Weight:   record.SRV.Weight,
+			Port:     record.SRV.Port,
+			Target:   dns.Fqdn(record.SRV.Target),
+		}
+	case "PTR":
+		hdr.Rrtype = dns.TypePTR
+		return &dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(record.PTR)}
+	default:
+		return nil
+	}
+}
+
 type Server struct {
 	udpConn net.PacketConn
 	tcpLn   net.Listener
@@ -205,10 +387,93 @@ type Server struct {
 }
 
 func New(udpConn net.PacketConn, tcpLn net.Listener, zones []types.Zone) (*Server, error) {
-	handler := &dnsHandler{zones: zones}
+	return NewWithConfiguration(udpConn, tcpLn, &types.Configuration{DNS: zones})
+}
+
+// NewWithConfiguration creates a server answering with the zones of the configuration, forwarding the other queries
+// to the upstream nameservers, or else resolving them with the host, and answering reverse lookups of the subnets.
+func NewWithConfiguration(udpConn net.PacketConn, tcpLn net.Listener, configuration *types.Configuration) (*Server, error) {
+	handler := &dnsHandler{zones: configuration.DNS}
+	if len(configuration.DNSUpstreamServers) > 0 {
+		handler.upstream = newUpstream(configuration.DNSUpstreamServers)
+	}
+	if configuration.DHCPHostnameZone != "" {
+		handler.hostnameZone = strings.ToLower(dns.Fqdn(configuration.DHCPHostnameZone))
+	}
+	for _, cidr := range []string{configuration.Subnet, configuration.IPv6Subnet} {
+		if cidr == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		handler.subnets = append(handler.subnets, subnet)
+	}
+	if configuration.DNSPassthrough {
+		if handler.upstream == nil {
+			return nil, errors.New("DNS passthrough requires upstream servers")
+		}
+		handler.passthrough = true
+	}
 	return &Server{udpConn: udpConn, tcpLn: tcpLn, handler: handler}, nil
 }
 
+// AddLeases makes the addresses leased by the DHCP servers resolvable, in both directions.
+// Leased addresses without record are named after their IP in the first zone, like 192-168-127-2.containers.internal.
+func (s *Server) AddLeases(source LeaseSource) {
+	s.handler.zonesLock.Lock()
+	defer s.handler.zonesLock.Unlock()
+	s.handler.leases = append(s.handler.leases, source)
+}
+
+// AddResolutionRecorder notifies the recorder of the addresses sent to the virtual machines.
+func (s *Server) AddResolutionRecorder(recorder ResolutionRecorder) {
+	s.handler.zonesLock.Lock()
+	defer s.handler.zonesLock.Unlock()
+	s.handler.recorders = append(s.handler.recorders, recorder)
+}
+
+// Lookup returns the IPv4 and IPv6 addresses of the name, as they would be answered to the virtual machines.
+func (s *Server) Lookup(name string) []net.IP {
+	var ips []net.IP
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		target := dns.Fqdn(name)
+		// follow the aliases of the zones, which are answered without their target
+		for i := 0; i < maxAliases && target != ""; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion(target, qtype)
+			m := new(dns.Msg)
+			m.SetReply(req)
+			s.handler.addAnswers(m)
+
+			target = ""
+			found := false
+			for _, rr := range m.Answer {
+				switch answer := rr.(type) {
+				case *dns.A:
+					ips = append(ips, answer.A)
+					found = true
+				case *dns.AAAA:
+					ips = append(ips, answer.AAAA)
+					found = true
+				case *dns.CNAME:
+					target = answer.Target
+				}
+			}
+			if found {
+				break
+			}
+		}
+	}
+	return ips
+}
+
+// WithListeners returns a server answering on other connections with the same zones.
+func (s *Server) WithListeners(udpConn net.PacketConn, tcpLn net.Listener) *Server {
+	return &Server{udpConn: udpConn, tcpLn: tcpLn, handler: s.handler}
+}
+
 func (s *Server) Serve() error {
 	mux := dns.NewServeMux()
 	mux.HandleFunc(".", s.handler.handleUDP)
@@ -251,9 +516,39 @@ func (s *Server) Mux() http.Handler {
 		s.addZone(req)
 		w.WriteHeader(http.StatusOK)
 	})
+
+	mux.HandleFunc("/remove", s.zoneHandler(func(req types.Zone) error {
+		return s.removeZone(req.Name)
+	}))
+	mux.HandleFunc("/replace", s.zoneHandler(func(req types.Zone) error {
+		s.replaceZone(req)
+		return nil
+	}))
+	mux.HandleFunc("/remove-records", s.zoneHandler(s.removeRecords))
+	mux.HandleFunc("/replace-records", s.zoneHandler(s.replaceRecords))
 	return mux
 }
 
+// zoneHandler decodes the zone posted to the endpoint and gives it to fn.
+func (s *Server) zoneHandler(fn func(req types.Zone) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "post only", http.StatusBadRequest)
+			return
+		}
+		var req types.Zone
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fn(req); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 func (s *Server) addZone(req types.Zone) {
 	s.handler.zonesLock.Lock()
 	defer s.handler.zonesLock.Unlock()
@@ -267,3 +562,74 @@ func (s *Server) addZone(req types.Zone) {
 	// No existing zone for req.Name, add new one
 	s.handler.zones = append(s.handler.zones, req)
 }
+
+// replaceZone sets the records and default IP of the zone, adding the zone if needed.
+func (s *Server) replaceZone(req types.Zone) {
+	s.handler.zonesLock.Lock()
+	defer s.handler.zonesLock.Unlock()
+	for i, zone := range s.handler.zones {
+		if zone.Name == req.Name {
+			s.handler.zones[i] = req
+			return
+		}
+	}
+	s.handler.zones = append(s.handler.zones, req)
+}
+
+func (s *Server) removeZone(name string) error {
+	s.handler.zonesLock.Lock()
+	defer s.handler.zonesLock.Unlock()
+	for i, zone := range s.handler.zones {
+		if zone.Name == name {
+			s.handler.zones = append(s.handler.zones[:i:i], s.handler.zones[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("zone %s not found", name)
+}
+
+// removeRecords removes the records of the zone with the same name and type as the requested ones.
+// A requested record without value removes all the records of its name.
+func (s *Server) removeRecords(req types.Zone) error {
+	s.handler.zonesLock.Lock()
+	defer s.handler.zonesLock.Unlock()
+	for i, zone := range s.handler.zones {
+		if zone.Name == req.Name {
+			s.handler.zones[i].Records = withoutRecords(zone.Records, req.Records)
+			return nil
+		}
+	}
+	return fmt.Errorf("zone %s not found", req.Name)
+}
+
+// replaceRecords replaces the records of the zone with the same name and type as the requested ones.
+// The zone is added if needed.
+func (s *Server) replaceRecords(req types.Zone) error {
+	s.handler.zonesLock.Lock()
+	defer s.handler.zonesLock.Unlock()
+	for i, zone := range s.handler.zones {
+		if zone.Name == req.Name {
+			s.handler.zones[i].Records = append(req.Records, withoutRecords(zone.Records, req.Records)...)
+			return nil
+		}
+	}
+	s.handler.zones = append(s.handler.zones, types.Zone{Name: req.Name, Records: req.Records})
+	return nil
+}
+
+func withoutRecords(records []types.Record, removed []types.Record) []types.Record {
+	var kept []types.Record
+	for _, record := range records {
+		keep := true
+		for _, candidate := range removed {
+			if record.SameName(candidate) && (candidate.Type() == "" || candidate.Type() == record.Type()) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
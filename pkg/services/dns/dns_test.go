@@ -3,8 +3,10 @@ package dns
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 )
@@ -192,3 +194,335 @@ var _ = ginkgo.Describe("dns add test", func() {
 		}))
 	})
 })
+
+var _ = ginkgo.Describe("dns remove and replace test", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server, _ = NewWithConfiguration(nil, nil, &types.Configuration{DNS: []types.Zone{
+			{
+				Name:      "crc.testing.",
+				DefaultIP: net.ParseIP("192.168.127.2"),
+			},
+			{
+				Name: "testing.",
+				Records: []types.Record{
+					{Name: "host", IP: net.ParseIP("192.168.127.3")},
+					{Name: "host", IP: net.ParseIP("fd00::3")},
+					{Name: "gateway", IP: net.ParseIP("192.168.127.1")},
+				},
+			},
+		}})
+	})
+
+	ginkgo.It("should remove a zone", func() {
+		gomega.Expect(server.removeZone("crc.testing.")).To(gomega.Succeed())
+		gomega.Expect(server.handler.zones).To(gomega.HaveLen(1))
+		gomega.Expect(server.handler.zones[0].Name).To(gomega.Equal("testing."))
+
+		gomega.Expect(server.removeZone("crc.testing.")).NotTo(gomega.Succeed())
+	})
+
+	ginkgo.It("should replace a zone", func() {
+		server.replaceZone(types.Zone{
+			Name:    "crc.testing.",
+			Records: []types.Record{{Name: "api", IP: net.ParseIP("192.168.127.4")}},
+		})
+		gomega.Expect(server.handler.zones[0]).To(gomega.Equal(types.Zone{
+			Name:    "crc.testing.",
+			Records: []types.Record{{Name: "api", IP: net.ParseIP("192.168.127.4")}},
+		}))
+	})
+
+	ginkgo.It("should remove records of a given type", func() {
+		gomega.Expect(server.removeRecords(types.Zone{
+			Name:    "testing.",
+			Records: []types.Record{{Name: "host", IP: net.ParseIP("fd00::1")}},
+		})).To(gomega.Succeed())
+		gomega.Expect(server.handler.zones[1].Records).To(gomega.Equal([]types.Record{
+			{Name: "host", IP: net.ParseIP("192.168.127.3")},
+			{Name: "gateway", IP: net.ParseIP("192.168.127.1")},
+		}))
+	})
+
+	ginkgo.It("should remove all the records of a name", func() {
+		gomega.Expect(server.removeRecords(types.Zone{
+			Name:    "testing.",
+			Records: []types.Record{{Name: "host"}},
+		})).To(gomega.Succeed())
+		gomega.Expect(server.handler.zones[1].Records).To(gomega.Equal([]types.Record{
+			{Name: "gateway", IP: net.ParseIP("192.168.127.1")},
+		}))
+	})
+
+	ginkgo.It("should replace records", func() {
+		gomega.Expect(server.replaceRecords(types.Zone{
+			Name:    "testing.",
+			Records: []types.Record{{Name: "host", IP: net.ParseIP("192.168.127.5")}},
+		})).To(gomega.Succeed())
+		gomega.Expect(server.handler.zones[1].Records).To(gomega.Equal([]types.Record{
+			{Name: "host", IP: net.ParseIP("192.168.127.5")},
+			{Name: "host", IP: net.ParseIP("fd00::3")},
+			{Name: "gateway", IP: net.ParseIP("192.168.127.1")},
+		}))
+	})
+})
+
+var _ = ginkgo.Describe("dns answers test", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server, _ = NewWithConfiguration(nil, nil, &types.Configuration{DNS: []types.Zone{
+			{
+				Name: "testing.",
+				Records: []types.Record{
+					{Name: "host", IP: net.ParseIP("192.168.127.3"), TTL: 60},
+					{Name: "host", IP: net.ParseIP("fd00::3")},
+					{Name: "www", CNAME: "host.testing"},
+					{Name: "host", TXT: []string{"v=spf1 -all"}},
+					{Name: "_http._tcp", SRV: &types.SRV{Priority: 10, Weight: 5, Port: 8080, Target: "host.testing."}},
+					{Name: "_http._tcp", SRV: &types.SRV{Priority: 20, Weight: 5, Port: 8081, Target: "host.testing."}},
+				},
+			},
+			{
+				Name:    "127.168.192.in-addr.arpa.",
+				Records: []types.Record{{Name: "3", PTR: "host.testing."}},
+			},
+		}})
+	})
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		server.handler.addAnswers(m)
+		return m
+	}
+
+	ginkgo.It("should answer A and AAAA records", func() {
+		m := query("host.testing.", dns.TypeA)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.3"))
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(60)))
+
+		m = query("host.testing.", dns.TypeAAAA)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.AAAA).AAAA.String()).To(gomega.Equal("fd00::3"))
+	})
+
+	ginkgo.It("should answer CNAME records for any type", func() {
+		m := query("www.testing.", dns.TypeA)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.CNAME).Target).To(gomega.Equal("host.testing."))
+	})
+
+	ginkgo.It("should answer TXT, SRV and PTR records", func() {
+		m := query("host.testing.", dns.TypeTXT)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.TXT).Txt).To(gomega.Equal([]string{"v=spf1 -all"}))
+
+		m = query("_http._tcp.testing.", dns.TypeSRV)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(m.Answer[1].(*dns.SRV).Port).To(gomega.Equal(uint16(8081)))
+
+		m = query("3.127.168.192.in-addr.arpa.", dns.TypePTR)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal("host.testing."))
+	})
+
+	ginkgo.It("should answer without records for other types", func() {
+		m := query("host.testing.", dns.TypeMX)
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+
+		m = query("unknown.testing.", dns.TypeA)
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+	})
+
+	ginkgo.It("should look up the addresses of a name through aliases", func() {
+		ips := server.Lookup("www.testing")
+		gomega.Expect(ips).To(gomega.HaveLen(2))
+		gomega.Expect(ips[0].String()).To(gomega.Equal("192.168.127.3"))
+		gomega.Expect(ips[1].String()).To(gomega.Equal("fd00::3"))
+	})
+
+	ginkgo.It("should record the resolved addresses with the names of the question and of the answer", func() {
+		recorder := resolutions{}
+		server.AddResolutionRecorder(recorder)
+		m := query("host.testing.", dns.TypeA)
+		m.Answer = append([]dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "www.testing.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+			Target: "host.testing.",
+		}}, m.Answer...)
+		m.Question[0].Name = "www.testing."
+		server.handler.recordResolutions(m)
+		gomega.Expect(recorder).To(gomega.Equal(resolutions{
+			"host.testing.": "192.168.127.3",
+			"www.testing.":  "192.168.127.3",
+		}))
+	})
+})
+
+var _ = ginkgo.Describe("dns resolutions test", func() {
+	ginkgo.It("should keep the names until they expire", func() {
+		now := time.Now()
+		resolutions := NewResolutionsWithClock(func() time.Time { return now })
+		resolutions.RecordResolution("WWW.example.com.", net.ParseIP("192.0.2.10"), 3600)
+		resolutions.RecordResolution("example.com.", net.ParseIP("192.0.2.10"), 60)
+		gomega.Expect(resolutions.Names(net.ParseIP("192.0.2.10"))).To(gomega.Equal([]string{"example.com", "www.example.com"}))
+
+		// short TTLs are extended, virtual machines may cache them longer
+		now = now.Add(10 * time.Minute)
+		gomega.Expect(resolutions.Names(net.ParseIP("192.0.2.10"))).To(gomega.Equal([]string{"www.example.com"}))
+
+		// the most recent resolution comes first
+		resolutions.RecordResolution("example.com.", net.ParseIP("192.0.2.10"), 60)
+		gomega.Expect(resolutions.Names(net.ParseIP("192.0.2.10"))).To(gomega.Equal([]string{"example.com", "www.example.com"}))
+		now = now.Add(time.Minute)
+		resolutions.RecordResolution("www.example.com.", net.ParseIP("192.0.2.10"), 3600)
+		gomega.Expect(resolutions.Names(net.ParseIP("192.0.2.10"))).To(gomega.Equal([]string{"www.example.com", "example.com"}))
+
+		now = now.Add(2 * time.Hour)
+		gomega.Expect(resolutions.Names(net.ParseIP("192.0.2.10"))).To(gomega.BeEmpty())
+	})
+})
+
+type resolutions map[string]string
+
+func (r resolutions) RecordResolution(name string, ip net.IP, _ uint32) {
+	r[name] = ip.String()
+}
+
+type staticLeases map[string]string
+
+func (l staticLeases) Leases() map[string]string {
+	return l
+}
+
+func (l staticLeases) Hostnames() map[string]string {
+	return map[string]string{"fedora": "192.168.127.3"}
+}
+
+var _ = ginkgo.Describe("dns reverse test", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server, _ = NewWithConfiguration(nil, nil, &types.Configuration{
+			Subnet:           "192.168.127.0/24",
+			IPv6Subnet:       "fd00::/64",
+			DHCPHostnameZone: "vm.containers.internal",
+			DNS: []types.Zone{{
+				Name: "containers.internal.",
+				Records: []types.Record{
+					{Name: "gateway", IP: net.ParseIP("192.168.127.1")},
+					{Name: "gateway", IP: net.ParseIP("fd00::1")},
+				},
+			}},
+		})
+		server.AddLeases(staticLeases{
+			"192.168.127.1": "5a:94:ef:e4:0c:dd",
+			"192.168.127.2": "5a:94:ef:e4:0c:ee",
+			"192.168.127.3": "5a:94:ef:e4:0c:ff",
+		})
+	})
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		server.handler.addAnswers(m)
+		return m
+	}
+
+	ginkgo.It("should parse reverse names", func() {
+		gomega.Expect(reverseIP("2.127.168.192.in-addr.arpa.").String()).To(gomega.Equal("192.168.127.2"))
+		gomega.Expect(reverseIP("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.").String()).To(gomega.Equal("fd00::1"))
+		gomega.Expect(reverseIP("127.168.192.in-addr.arpa.")).To(gomega.BeNil())
+		gomega.Expect(reverseIP("example.com.")).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should answer with the names of the records", func() {
+		m := query("1.127.168.192.in-addr.arpa.", dns.TypePTR)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal("gateway.containers.internal."))
+
+		m = query("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal("gateway.containers.internal."))
+	})
+
+	ginkgo.It("should answer with the names of the leases", func() {
+		m := query("2.127.168.192.in-addr.arpa.", dns.TypePTR)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal("192-168-127-2.containers.internal."))
+
+		// the name resolves to the same address, like sshd UseDNS checks
+		m = query(m.Answer[0].(*dns.PTR).Ptr, dns.TypeA)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.2"))
+
+		m = query("192-168-127-2.containers.internal.", dns.TypeAAAA)
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+
+		// addresses without lease have no name
+		m = query("192-168-127-9.containers.internal.", dns.TypeA)
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+	})
+
+	ginkgo.It("should answer with the hostnames of the DHCP clients", func() {
+		m := query("fedora.vm.containers.internal.", dns.TypeA)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.3"))
+
+		m = query("3.127.168.192.in-addr.arpa.", dns.TypePTR)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal("fedora.vm.containers.internal."))
+
+		m = query("ubuntu.vm.containers.internal.", dns.TypeA)
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+	})
+
+	ginkgo.It("should not resolve unknown names of the hostname zone elsewhere", func() {
+		server, _ = NewWithConfiguration(nil, nil, &types.Configuration{
+			Subnet:           "192.168.127.0/24",
+			DHCPHostnameZone: "vm.containers.internal",
+			DNS: []types.Zone{{
+				Name:      "containers.internal.",
+				DefaultIP: net.ParseIP("192.168.127.254"),
+			}},
+		})
+		server.AddLeases(staticLeases{"192.168.127.3": "5a:94:ef:e4:0c:ff"})
+		m := query("ubuntu.vm.containers.internal.", dns.TypeA)
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+
+		// unless the zone also holds static records
+		server, _ = NewWithConfiguration(nil, nil, &types.Configuration{
+			Subnet:           "192.168.127.0/24",
+			DHCPHostnameZone: "vm.containers.internal",
+			DNS: []types.Zone{{
+				Name:    "vm.containers.internal.",
+				Records: []types.Record{{Name: "printer", IP: net.ParseIP("192.168.127.10")}},
+			}},
+		})
+		server.AddLeases(staticLeases{"192.168.127.3": "5a:94:ef:e4:0c:ff"})
+		m = query("printer.vm.containers.internal.", dns.TypeA)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.10"))
+		m = query("ubuntu.vm.containers.internal.", dns.TypeA)
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+	})
+
+	ginkgo.It("should not resolve unknown addresses of the virtual network with the host", func() {
+		m := query("4.127.168.192.in-addr.arpa.", dns.TypePTR)
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+
+		req := new(dns.Msg)
+		req.SetQuestion("4.127.168.192.in-addr.arpa.", dns.TypePTR)
+		gomega.Expect(server.handler.inZones(req)).To(gomega.BeTrue())
+	})
+})
@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Virtual machines may keep the addresses in cache longer than their TTL
+	minResolutionTTL = 5 * time.Minute
+	// Bound of the resolved addresses, to not grow without limit
+	maxResolutions = 65536
+)
+
+// Resolutions remembers the names resolved by the virtual machines, to find the names of the addresses they connect to.
+type Resolutions struct {
+	// indexed by IP, then by name
+	names map[string]map[string]resolution
+	lock  sync.Mutex
+
+	now func() time.Time
+}
+
+type resolution struct {
+	resolved time.Time
+	expiry   time.Time
+}
+
+func NewResolutions() *Resolutions {
+	return NewResolutionsWithClock(time.Now)
+}
+
+// NewResolutionsWithClock returns Resolutions getting the current time from now instead of the system clock.
+func NewResolutionsWithClock(now func() time.Time) *Resolutions {
+	return &Resolutions{
+		names: make(map[string]map[string]resolution),
+		now:   now,
+	}
+}
+
+// RecordResolution implements ResolutionRecorder.
+func (r *Resolutions) RecordResolution(name string, ip net.IP, ttl uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	duration := time.Duration(ttl) * time.Second
+	if duration < minResolutionTTL {
+		duration = minResolutionTTL
+	}
+	key := ip.String()
+	if _, ok := r.names[key]; !ok {
+		if len(r.names) >= maxResolutions {
+			r.evict(now)
+		}
+		r.names[key] = make(map[string]resolution)
+	}
+	r.names[key][strings.TrimSuffix(strings.ToLower(name), ".")] = resolution{resolved: now, expiry: now.Add(duration)}
+}
+
+// evict removes the expired names. The lock must be held.
+func (r *Resolutions) evict(now time.Time) {
+	for ip, names := range r.names {
+		for name, resolution := range names {
+			if !now.Before(resolution.expiry) {
+				delete(names, name)
+			}
+		}
+		if len(names) == 0 {
+			delete(r.names, ip)
+		}
+	}
+	if len(r.names) < maxResolutions {
+		return
+	}
+	for ip := range r.names {
+		delete(r.names, ip)
+		return
+	}
+}
+
+// Names returns the names resolved to the address which didn't expire, in lower case and without trailing dot.
+// The most recently resolved names come first.
+func (r *Resolutions) Names(ip net.IP) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	var names []string
+	resolutions := r.names[ip.String()]
+	for name, resolution := range resolutions {
+		if now.Before(resolution.expiry) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		first, second := resolutions[names[i]].resolved, resolutions[names[j]].resolved
+		if !first.Equal(second) {
+			return first.After(second)
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LeaseSource gives the addresses leased by the DHCP servers. It is implemented by tap.IPPool.
+type LeaseSource interface {
+	// MAC addresses indexed by IP
+	Leases() map[string]string
+	// IPs indexed by the hostnames sent by the clients
+	Hostnames() map[string]string
+}
+
+// reverseIP returns the address of a name of the in-addr.arpa. or ip6.arpa. zones, or nil.
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			b, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(b)
+		}
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			b, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			pos := len(nibbles) - 1 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(b) << 4
+			} else {
+				ip[pos/2] |= byte(b)
+			}
+		}
+		return ip
+	default:
+		return nil
+	}
+}
+
+// isVirtual returns whether the address belongs to the virtual network.
+func (h *dnsHandler) isVirtual(ip net.IP) bool {
+	for _, subnet := range h.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseName returns the name of an address of the virtual network, or an empty string.
+// Records of the zones are used first, then the DHCP leases. The zones lock must be held.
+func (h *dnsHandler) reverseName(ip net.IP) string {
+	for _, zone := range h.zones {
+		for _, record := range zone.Records {
+			if record.Name != "" && record.IP != nil && record.IP.Equal(ip) {
+				return dns.Fqdn(record.Name + "." + zone.Name)
+			}
+		}
+	}
+	if h.hostnameZone != "" {
+		for _, source := range h.leases {
+			for hostname, leased := range source.Hostnames() {
+				if leased == ip.String() {
+					return hostname + "." + h.hostnameZone
+				}
+			}
+		}
+	}
+	if h.isLeased(ip) && len(h.zones) > 0 {
+		return dns.Fqdn(leaseLabel(ip) + "." + h.zones[0].Name)
+	}
+	return ""
+}
+
+func (h *dnsHandler) isLeased(ip net.IP) bool {
+	for _, source := range h.leases {
+		if _, ok := source.Leases()[ip.String()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseLabel is the label of the name given to leased addresses without record, like 192-168-127-2.
+func leaseLabel(ip net.IP) string {
+	if ip.To4() != nil {
+		return strings.ReplaceAll(ip.String(), ".", "-")
+	}
+	return strings.ReplaceAll(ip.String(), ":", "-")
+}
+
+// leaseIP returns the leased address of a label built by leaseLabel, or nil.
+func (h *dnsHandler) leaseIP(label string) net.IP {
+	ip := net.ParseIP(strings.ReplaceAll(label, "-", "."))
+	if ip == nil {
+		ip = net.ParseIP(strings.ReplaceAll(label, "-", ":"))
+	}
+	if ip == nil || !h.isLeased(ip) || leaseLabel(ip) != label {
+		return nil
+	}
+	return ip
+}
+
+// hasZone returns whether one of the zones has the given name. The zones lock must be held.
+func (h *dnsHandler) hasZone(name string) bool {
+	for _, zone := range h.zones {
+		if strings.EqualFold(dns.Fqdn(zone.Name), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostnameIP returns the address leased to the client with the given hostname, or nil.
+func (h *dnsHandler) hostnameIP(hostname string) net.IP {
+	for _, source := range h.leases {
+		if ip, ok := source.Hostnames()[hostname]; ok {
+			return net.ParseIP(ip)
+		}
+	}
+	return nil
+}
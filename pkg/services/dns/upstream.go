@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	upstreamTimeout = 2 * time.Second
+
+	// Bounds of the cache, to not keep records forever and not grow without limit
+	cacheMaxEntries = 4096
+	cacheMaxTTL     = 24 * time.Hour
+)
+
+// upstream resolves the names that are not part of the local zones with a list of nameservers.
+// Responses are cached for the TTL given by the nameservers.
+type upstream struct {
+	servers []string
+	cache   *cache
+}
+
+func newUpstream(servers []string) *upstream {
+	var addresses []string
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			// port 53 is implied
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		addresses = append(addresses, server)
+	}
+	return &upstream{
+		servers: addresses,
+		cache:   newCache(),
+	}
+}
+
+// resolve returns the response of the nameservers for the question, from the cache if possible.
+func (u *upstream) resolve(q dns.Question) (*dns.Msg, error) {
+	key := newCacheKey(q)
+	if cached := u.cache.get(key); cached != nil {
+		return cached, nil
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	res, err := u.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	u.cache.set(key, res)
+	return res, nil
+}
+
+// forward relays a request of a client as is, with its flags and EDNS options.
+// The response is cached only when it doesn't depend on client specific options.
+func (u *upstream) forward(r *dns.Msg) (*dns.Msg, error) {
+	edns0 := r.IsEdns0()
+	cacheable := r.Opcode == dns.OpcodeQuery && len(r.Question) == 1 && (edns0 == nil || len(edns0.Option) == 0)
+	var key cacheKey
+	if cacheable {
+		key = newCacheKey(r.Question[0])
+		key.dnssecOK = edns0 != nil && edns0.Do()
+		key.checkingDisabled = r.CheckingDisabled
+		if cached := u.cache.get(key); cached != nil {
+			return cached, nil
+		}
+	}
+
+	req := r.Copy()
+	req.Id = dns.Id()
+	res, err := u.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		u.cache.set(key, res)
+	}
+	return res, nil
+}
+
+// exchange sends the request to each nameserver in turn until one answers.
+func (u *upstream) exchange(req *dns.Msg) (*dns.Msg, error) {
+	udpClient := &dns.Client{Net: "udp", Timeout: upstreamTimeout}
+	tcpClient := &dns.Client{Net: "tcp", Timeout: upstreamTimeout}
+
+	err := errors.New("no upstream nameserver")
+	for _, server := range u.servers {
+		var res *dns.Msg
+		res, _, err = udpClient.Exchange(req, server)
+		if err == nil && res.Truncated {
+			res, _, err = tcpClient.Exchange(req, server)
+		}
+		if err != nil {
+			log.Debugf("dns: cannot query %s: %v", server, err)
+			continue
+		}
+		if res.Rcode == dns.RcodeServerFailure || res.Rcode == dns.RcodeRefused {
+			err = errors.New(dns.RcodeToString[res.Rcode])
+			continue
+		}
+		return res, nil
+	}
+	return nil, err
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+
+	// flags of forwarded requests changing the response
+	dnssecOK         bool
+	checkingDisabled bool
+}
+
+func newCacheKey(q dns.Question) cacheKey {
+	return cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}
+}
+
+type cacheEntry struct {
+	msg    *dns.Msg
+	stored time.Time
+	expiry time.Time
+}
+
+type cache struct {
+	entries map[cacheKey]cacheEntry
+	lock    sync.Mutex
+
+	now func() time.Time
+}
+
+func newCache() *cache {
+	return &cache{
+		entries: make(map[cacheKey]cacheEntry),
+		now:     time.Now,
+	}
+}
+
+// get returns a copy of the cached response with the TTLs decreased by the time spent in the cache.
+func (c *cache) get(key cacheKey) *dns.Msg {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	now := c.now()
+	if !now.Before(entry.expiry) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	elapsed := uint32(now.Sub(entry.stored).Seconds())
+	msg := entry.msg.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return msg
+}
+
+// set stores the response for the lowest TTL of its records.
+// Negative responses are stored for the TTL of the SOA record (RFC 2308 section 5).
+func (c *cache) set(key cacheKey, msg *dns.Msg) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+	ttl, ok := cacheTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	if len(c.entries) >= cacheMaxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = cacheEntry{
+		msg:    msg.Copy(),
+		stored: now,
+		expiry: now.Add(ttl),
+	}
+}
+
+// evict removes the expired entries, or an arbitrary one if none expired. The lock must be held.
+func (c *cache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiry) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) < cacheMaxEntries {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}
+
+func cacheTTL(msg *dns.Msg) (time.Duration, bool) {
+	var records []dns.RR
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		records = msg.Answer
+	} else {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				records = append(records, &dns.SOA{Hdr: soa.Hdr, Minttl: soa.Minttl})
+			}
+		}
+	}
+	if len(records) == 0 {
+		return 0, false
+	}
+
+	ttl := uint32(cacheMaxTTL.Seconds())
+	for _, rr := range records {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+	return time.Duration(ttl) * time.Second, true
+}
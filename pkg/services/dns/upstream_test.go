@@ -0,0 +1,147 @@
+package dns
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns upstream test", func() {
+	var (
+		server  *Server
+		nsConn  net.PacketConn
+		queries int32
+	)
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		nsConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		atomic.StoreInt32(&queries, 0)
+		mux := dns.NewServeMux()
+		mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if opt := r.IsEdns0(); opt != nil && opt.Do() {
+				m.AuthenticatedData = true
+				m.SetEdns0(opt.UDPSize(), true)
+			}
+			if r.Question[0].Qtype == dns.TypeAAAA {
+				m.Answer = append(m.Answer, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300},
+					AAAA: net.ParseIP("2001:db8::10"),
+				})
+			} else if r.Question[0].Name == "example.com." {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP("192.0.2.10"),
+				})
+			} else {
+				m.Rcode = dns.RcodeNameError
+				m.Ns = append(m.Ns, &dns.SOA{
+					Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900},
+					Ns:     "ns.com.",
+					Mbox:   "hostmaster.com.",
+					Minttl: 60,
+				})
+			}
+			_ = w.WriteMsg(m)
+		})
+		go func() {
+			_ = (&dns.Server{PacketConn: nsConn, Handler: mux}).ActivateAndServe()
+		}()
+
+		server, _ = NewWithConfiguration(nil, nil, &types.Configuration{
+			DNSUpstreamServers: []string{nsConn.LocalAddr().String()},
+		})
+	})
+
+	ginkgo.AfterEach(func() {
+		nsConn.Close()
+	})
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		server.handler.addAnswers(m)
+		return m
+	}
+
+	ginkgo.It("should pass the upstream TTL and cache the response", func() {
+		m := query("example.com.")
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(300)))
+
+		now := time.Now()
+		server.handler.upstream.cache.now = func() time.Time { return now.Add(100 * time.Second) }
+		m = query("EXAMPLE.com.")
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.BeNumerically("<=", 200))
+		gomega.Expect(atomic.LoadInt32(&queries)).To(gomega.Equal(int32(1)))
+
+		server.handler.upstream.cache.now = func() time.Time { return now.Add(400 * time.Second) }
+		m = query("example.com.")
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(300)))
+		gomega.Expect(atomic.LoadInt32(&queries)).To(gomega.Equal(int32(2)))
+	})
+
+	ginkgo.It("should cache negative responses for the SOA minimum TTL", func() {
+		m := query("missing.com.")
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+
+		now := time.Now()
+		server.handler.upstream.cache.now = func() time.Time { return now.Add(30 * time.Second) }
+		m = query("missing.com.")
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+		gomega.Expect(atomic.LoadInt32(&queries)).To(gomega.Equal(int32(1)))
+
+		server.handler.upstream.cache.now = func() time.Time { return now.Add(90 * time.Second) }
+		query("missing.com.")
+		gomega.Expect(atomic.LoadInt32(&queries)).To(gomega.Equal(int32(2)))
+	})
+
+	ginkgo.It("should relay requests and responses as is in passthrough mode", func() {
+		server, _ = NewWithConfiguration(nil, nil, &types.Configuration{
+			DNS:                []types.Zone{{Name: "internal.", DefaultIP: net.ParseIP("192.168.127.1")}},
+			DNSUpstreamServers: []string{nsConn.LocalAddr().String()},
+			DNSPassthrough:     true,
+		})
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeAAAA)
+		req.SetEdns0(dns.DefaultMsgSize, true)
+		gomega.Expect(server.handler.inZones(req)).To(gomega.BeFalse())
+		m := server.handler.forward(req)
+		gomega.Expect(m.Id).To(gomega.Equal(req.Id))
+		gomega.Expect(m.AuthenticatedData).To(gomega.BeTrue())
+		gomega.Expect(m.IsEdns0()).NotTo(gomega.BeNil())
+		gomega.Expect(m.IsEdns0().Do()).To(gomega.BeTrue())
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.AAAA).AAAA.String()).To(gomega.Equal("2001:db8::10"))
+
+		// the response with DNSSEC is not used for requests without the DO bit
+		req = new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeAAAA)
+		m = server.handler.forward(req)
+		gomega.Expect(m.AuthenticatedData).To(gomega.BeFalse())
+		gomega.Expect(atomic.LoadInt32(&queries)).To(gomega.Equal(int32(2)))
+
+		req.SetQuestion("host.internal.", dns.TypeA)
+		gomega.Expect(server.handler.inZones(req)).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should require upstream servers in passthrough mode", func() {
+		_, err := NewWithConfiguration(nil, nil, &types.Configuration{DNSPassthrough: true})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
@@ -0,0 +1,297 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Firewall decides whether the virtual machines can open connections to a destination.
+// Rules about names use the addresses sent to the virtual machines by the DNS server of the gateway.
+type Firewall struct {
+	policy types.Firewall
+	rules  []rule
+	lock   sync.RWMutex
+
+	resolutions *dns.Resolutions
+
+	// rules apply to the translated destinations
+	nat     map[tcpip.Address]tcpip.Address
+	natLock *sync.Mutex
+}
+
+type rule struct {
+	action   types.FirewallAction
+	protocol types.TransportProtocol
+	network  *net.IPNet
+	minPort  uint16
+	maxPort  uint16
+	// lower case, without trailing dot
+	name string
+}
+
+func New(configuration *types.Configuration, resolutions *dns.Resolutions, nat map[tcpip.Address]tcpip.Address, natLock *sync.Mutex) (*Firewall, error) {
+	firewall := &Firewall{
+		resolutions: resolutions,
+		nat:         nat,
+		natLock:     natLock,
+	}
+	if configuration.Firewall != nil {
+		if err := firewall.set(*configuration.Firewall); err != nil {
+			return nil, err
+		}
+	}
+	return firewall, nil
+}
+
+// Filter returns a transport protocol handler dropping the packets of denied connections before passing the others to handler.
+// The stack then answers to the dropped packets with a TCP reset or an ICMP port unreachable.
+func (f *Firewall) Filter(protocol types.TransportProtocol, handler func(stack.TransportEndpointID, stack.PacketBufferPtr) bool) func(stack.TransportEndpointID, stack.PacketBufferPtr) bool {
+	return func(id stack.TransportEndpointID, pkt stack.PacketBufferPtr) bool {
+		destination := f.translate(id.LocalAddress)
+		if !f.Allowed(protocol, net.IP(destination.AsSlice()), id.LocalPort) {
+			log.Debugf("firewall: %s connection from %s to %s (%s) denied", protocol, id.RemoteAddress, net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort))), destination)
+			return false
+		}
+		return handler(id, pkt)
+	}
+}
+
+// AllowedEcho returns whether the virtual machines can ping the destination, after its address translation.
+func (f *Firewall) AllowedEcho(destination tcpip.Address) bool {
+	translated := f.translate(destination)
+	return f.Allowed(types.ICMP, net.IP(translated.AsSlice()), 0)
+}
+
+// translate returns the address really reached by the connections to address.
+func (f *Firewall) translate(address tcpip.Address) tcpip.Address {
+	f.natLock.Lock()
+	defer f.natLock.Unlock()
+	if replaced, ok := f.nat[address]; ok {
+		return replaced
+	}
+	return address
+}
+
+// Allowed returns the action of the first rule matching the destination, or the default action.
+func (f *Firewall) Allowed(protocol types.TransportProtocol, ip net.IP, port uint16) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var names []string
+	namesResolved := false
+	for _, rule := range f.rules {
+		if rule.protocol != "" && rule.protocol != protocol {
+			continue
+		}
+		if rule.network != nil && !rule.network.Contains(ip) {
+			continue
+		}
+		if rule.maxPort != 0 && (port < rule.minPort || port > rule.maxPort) {
+			continue
+		}
+		if rule.name != "" {
+			if !namesResolved {
+				names = f.resolutions.Names(ip)
+				namesResolved = true
+			}
+			if !matchesAny(rule.name, names) {
+				continue
+			}
+		}
+		return rule.action == types.Allow
+	}
+	return f.policy.DefaultAction != types.Deny
+}
+
+func matchesAny(pattern string, names []string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(name, pattern[1:]) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func parseRule(config types.FirewallRule) (rule, error) {
+	parsed := rule{
+		action:   config.Action,
+		protocol: config.Protocol,
+		name:     normalize(config.Name),
+	}
+	switch config.Action {
+	case types.Allow, types.Deny:
+	default:
+		return rule{}, fmt.Errorf("invalid action %q", config.Action)
+	}
+	switch config.Protocol {
+	case "", types.TCP, types.UDP:
+	case types.ICMP:
+		if config.Ports != "" {
+			return rule{}, errors.New("icmp rules have no ports")
+		}
+	default:
+		return rule{}, fmt.Errorf("invalid protocol %q", config.Protocol)
+	}
+	if config.Destination != "" {
+		destination := config.Destination
+		if !strings.Contains(destination, "/") {
+			if ip := net.ParseIP(destination); ip != nil && ip.To4() != nil {
+				destination += "/32"
+			} else {
+				destination += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(destination)
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid destination %q", config.Destination)
+		}
+		parsed.network = network
+	}
+	if config.Ports != "" {
+		bounds := strings.SplitN(config.Ports, "-", 2)
+		minPort, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid ports %q", config.Ports)
+		}
+		maxPort := minPort
+		if len(bounds) == 2 {
+			maxPort, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil {
+				return rule{}, fmt.Errorf("invalid ports %q", config.Ports)
+			}
+		}
+		if minPort == 0 || maxPort < minPort {
+			return rule{}, fmt.Errorf("invalid ports %q", config.Ports)
+		}
+		parsed.minPort, parsed.maxPort = uint16(minPort), uint16(maxPort)
+	}
+	return parsed, nil
+}
+
+func parsePolicy(policy types.Firewall) ([]rule, error) {
+	switch policy.DefaultAction {
+	case "", types.Allow, types.Deny:
+	default:
+		return nil, fmt.Errorf("invalid default action %q", policy.DefaultAction)
+	}
+	var rules []rule
+	for _, config := range policy.Rules {
+		parsed, err := parseRule(config)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, parsed)
+	}
+	return rules, nil
+}
+
+func (f *Firewall) set(policy types.Firewall) error {
+	rules, err := parsePolicy(policy)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.policy = policy
+	f.rules = rules
+	return nil
+}
+
+func (f *Firewall) addRule(config types.FirewallRule) error {
+	parsed, err := parseRule(config)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.policy.Rules = append(f.policy.Rules, config)
+	f.rules = append(f.rules, parsed)
+	return nil
+}
+
+// removeRule removes the rules identical to config.
+func (f *Firewall) removeRule(config types.FirewallRule) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var configs []types.FirewallRule
+	var rules []rule
+	for i, existing := range f.policy.Rules {
+		if existing != config {
+			configs = append(configs, existing)
+			rules = append(rules, f.rules[i])
+		}
+	}
+	if len(configs) == len(f.policy.Rules) {
+		return errors.New("rule not found")
+	}
+	f.policy.Rules = configs
+	f.rules = rules
+	return nil
+}
+
+func (f *Firewall) Mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/all", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.RLock()
+		defer f.lock.RUnlock()
+		_ = json.NewEncoder(w).Encode(f.policy)
+	})
+	mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "post only", http.StatusBadRequest)
+			return
+		}
+		var req types.Firewall
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.set(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/add", ruleHandler(f.addRule))
+	mux.HandleFunc("/remove", ruleHandler(f.removeRule))
+	return mux
+}
+
+func ruleHandler(fn func(config types.FirewallRule) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "post only", http.StatusBadRequest)
+			return
+		}
+		var req types.FirewallRule
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fn(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
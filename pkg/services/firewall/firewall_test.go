@@ -0,0 +1,105 @@
+package firewall
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestRules(t *testing.T) {
+	firewall, err := New(&types.Configuration{
+		Firewall: &types.Firewall{
+			Rules: []types.FirewallRule{
+				{Action: types.Deny, Destination: "169.254.169.254"},
+				{Action: types.Allow, Destination: "192.168.1.10", Protocol: types.TCP, Ports: "22"},
+				{Action: types.Deny, Destination: "192.168.0.0/16"},
+				{Action: types.Deny, Protocol: types.UDP, Ports: "5000-5999"},
+			},
+		},
+	}, dns.NewResolutions(), nil, &sync.Mutex{})
+	assert.NoError(t, err)
+
+	assert.False(t, firewall.Allowed(types.TCP, net.ParseIP("169.254.169.254"), 80))
+	assert.True(t, firewall.Allowed(types.TCP, net.ParseIP("192.168.1.10"), 22))
+	assert.False(t, firewall.Allowed(types.UDP, net.ParseIP("192.168.1.10"), 22))
+	assert.False(t, firewall.Allowed(types.TCP, net.ParseIP("192.168.1.10"), 443))
+	assert.False(t, firewall.Allowed(types.UDP, net.ParseIP("1.1.1.1"), 5353))
+	assert.True(t, firewall.Allowed(types.TCP, net.ParseIP("1.1.1.1"), 5353))
+	assert.True(t, firewall.Allowed(types.UDP, net.ParseIP("1.1.1.1"), 6000))
+
+	assert.NoError(t, firewall.removeRule(types.FirewallRule{Action: types.Deny, Destination: "192.168.0.0/16"}))
+	assert.True(t, firewall.Allowed(types.TCP, net.ParseIP("192.168.1.10"), 443))
+	assert.Error(t, firewall.removeRule(types.FirewallRule{Action: types.Deny, Destination: "192.168.0.0/16"}))
+}
+
+func TestNames(t *testing.T) {
+	now := time.Now()
+	firewall, err := New(&types.Configuration{
+		Firewall: &types.Firewall{
+			DefaultAction: types.Deny,
+			Rules: []types.FirewallRule{
+				{Action: types.Allow, Name: "*.fedoraproject.org", Ports: "443"},
+				{Action: types.Allow, Name: "github.com"},
+			},
+		},
+	}, dns.NewResolutionsWithClock(func() time.Time { return now }), nil, &sync.Mutex{})
+	assert.NoError(t, err)
+	assert.False(t, firewall.Allowed(types.TCP, net.ParseIP("140.82.121.4"), 443))
+	firewall.resolutions.RecordResolution("GitHub.com.", net.ParseIP("140.82.121.4"), 60)
+	firewall.resolutions.RecordResolution("mirrors.fedoraproject.org.", net.ParseIP("38.145.60.20"), 60)
+	assert.True(t, firewall.Allowed(types.TCP, net.ParseIP("140.82.121.4"), 443))
+	assert.True(t, firewall.Allowed(types.TCP, net.ParseIP("38.145.60.20"), 443))
+	assert.False(t, firewall.Allowed(types.TCP, net.ParseIP("38.145.60.20"), 80))
+
+	now = now.Add(time.Hour)
+	assert.False(t, firewall.Allowed(types.TCP, net.ParseIP("140.82.121.4"), 443))
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rule := range []types.FirewallRule{
+		{Action: "reject"},
+		{Action: types.Allow, Protocol: "sctp"},
+		{Action: types.Allow, Destination: "192.168.0.0/33"},
+		{Action: types.Allow, Ports: "0"},
+		{Action: types.Allow, Ports: "9000-8000"},
+		{Action: types.Allow, Protocol: types.ICMP, Ports: "22"},
+	} {
+		_, err := New(&types.Configuration{Firewall: &types.Firewall{Rules: []types.FirewallRule{rule}}}, dns.NewResolutions(), nil, &sync.Mutex{})
+		assert.Error(t, err, "%+v", rule)
+	}
+}
+
+func TestTranslatedDestination(t *testing.T) {
+	virtualIP := tcpip.AddrFrom4Slice(net.ParseIP("192.168.127.254").To4())
+	nat := map[tcpip.Address]tcpip.Address{virtualIP: tcpip.AddrFrom4Slice(net.ParseIP("127.0.0.1").To4())}
+	firewall, err := New(&types.Configuration{
+		Firewall: &types.Firewall{
+			Rules: []types.FirewallRule{
+				{Action: types.Deny, Destination: "127.0.0.0/8"},
+				{Action: types.Deny, Protocol: types.ICMP, Destination: "10.0.0.0/8"},
+			},
+		},
+	}, dns.NewResolutions(), nat, &sync.Mutex{})
+	assert.NoError(t, err)
+
+	handled := false
+	filter := firewall.Filter(types.TCP, func(stack.TransportEndpointID, stack.PacketBufferPtr) bool {
+		handled = true
+		return true
+	})
+	assert.False(t, filter(stack.TransportEndpointID{LocalAddress: virtualIP, LocalPort: 22}, nil))
+	assert.False(t, handled)
+	assert.True(t, filter(stack.TransportEndpointID{LocalAddress: tcpip.AddrFrom4Slice(net.ParseIP("10.0.0.1").To4()), LocalPort: 22}, nil))
+	assert.True(t, handled)
+
+	assert.False(t, firewall.AllowedEcho(virtualIP))
+	assert.False(t, firewall.AllowedEcho(tcpip.AddrFrom4Slice(net.ParseIP("10.0.0.1").To4())))
+	assert.True(t, firewall.AllowedEcho(tcpip.AddrFrom4Slice(net.ParseIP("1.1.1.1").To4())))
+}
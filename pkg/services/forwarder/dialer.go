@@ -0,0 +1,182 @@
+package forwarder
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	netproxy "golang.org/x/net/proxy"
+)
+
+const proxyTimeout = 30 * time.Second
+
+// Dialer opens the TCP connections of the virtual machines, directly or through a HTTP CONNECT or SOCKS5 proxy.
+// The proxy is asked for the name last resolved by the virtual machine when it is known, else for the IP.
+type Dialer struct {
+	proxy *url.URL
+	socks netproxy.Dialer
+
+	noProxyNetworks []*net.IPNet
+	// lower case, without leading or trailing dot
+	noProxyDomains []string
+
+	resolutions *dns.Resolutions
+}
+
+func NewDialer(configuration *types.Configuration, resolutions *dns.Resolutions) (*Dialer, error) {
+	dialer := &Dialer{resolutions: resolutions}
+	if configuration.OutboundProxy == nil || configuration.OutboundProxy.URL == "" {
+		return dialer, nil
+	}
+
+	proxyURL, err := url.Parse(configuration.OutboundProxy.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http":
+		if proxyURL.Port() == "" {
+			proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	case "socks5", "socks5h":
+		if proxyURL.Port() == "" {
+			proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), "1080")
+		}
+		var auth *netproxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &netproxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		dialer.socks, err = netproxy.SOCKS5("tcp", proxyURL.Host, auth, &net.Dialer{Timeout: proxyTimeout})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	dialer.proxy = proxyURL
+
+	for _, entry := range configuration.OutboundProxy.NoProxy {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			dialer.noProxyNetworks = append(dialer.noProxyNetworks, network)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			dialer.noProxyNetworks = append(dialer.noProxyNetworks, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+			continue
+		}
+		domain := strings.Trim(strings.TrimPrefix(strings.ToLower(entry), "*"), ".")
+		if domain != "" {
+			dialer.noProxyDomains = append(dialer.noProxyDomains, domain)
+		}
+	}
+	return dialer, nil
+}
+
+func (d *Dialer) Dial(ip net.IP, port uint16) (net.Conn, error) {
+	var names []string
+	if d.resolutions != nil {
+		names = d.resolutions.Names(ip)
+	}
+	if d.proxy == nil || d.direct(ip, names) {
+		return net.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+
+	host := ip.String()
+	if len(names) > 0 {
+		host = names[0]
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if d.socks != nil {
+		return d.socks.Dial("tcp", address)
+	}
+	return d.connect(address)
+}
+
+// direct returns whether the destination is excluded from the proxy.
+func (d *Dialer) direct(ip net.IP, names []string) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, network := range d.noProxyNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, domain := range d.noProxyDomains {
+		for _, name := range names {
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connect opens a tunnel to address with the CONNECT method of the HTTP proxy.
+func (d *Dialer) connect(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.proxy.Host, proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(proxyTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", address, res.Status)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reader.Buffered() > 0 {
+		// the server spoke first and its data was read with the response
+		return &BufferedConn{Conn: conn, Reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// BufferedConn reads first the data received after a handshake that is left in the reader.
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
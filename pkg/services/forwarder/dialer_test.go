@@ -0,0 +1,127 @@
+package forwarder
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// serve accepts one connection and answers with handle, which returns the destination asked to the proxy.
+func serve(t *testing.T, handle func(conn net.Conn, reader *bufio.Reader) string) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	destinations := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		destinations <- handle(conn, bufio.NewReader(conn))
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln, destinations
+}
+
+func TestHTTPProxy(t *testing.T) {
+	ln, destinations := serve(t, func(conn net.Conn, reader *bufio.Reader) string {
+		req, err := http.ReadRequest(reader)
+		if err != nil || req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return ""
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+		return req.Host
+	})
+
+	// the proxy is asked for the last name resolved to the address
+	now := time.Now()
+	resolutions := dns.NewResolutionsWithClock(func() time.Time { return now })
+	resolutions.RecordResolution("cdn.example.net.", net.ParseIP("192.0.2.10"), 60)
+	now = now.Add(time.Second)
+	resolutions.RecordResolution("example.com.", net.ParseIP("192.0.2.10"), 60)
+	dialer, err := NewDialer(&types.Configuration{
+		OutboundProxy: &types.OutboundProxy{URL: "http://user:secret@" + ln.Addr().String()},
+	}, resolutions)
+	assert.NoError(t, err)
+
+	conn, err := dialer.Dial(net.ParseIP("192.0.2.10"), 443)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "example.com:443", <-destinations)
+	data, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	ln, destinations := serve(t, func(conn net.Conn, reader *bufio.Reader) string {
+		// version, methods, then the no authentication method is selected
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(reader, greeting); err != nil {
+			return ""
+		}
+		if _, err := io.ReadFull(reader, make([]byte, greeting[1])); err != nil {
+			return ""
+		}
+		_, _ = conn.Write([]byte{5, 0})
+
+		// version, connect, reserved, then a domain name address
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(reader, header); err != nil || header[3] != 3 {
+			return ""
+		}
+		destination := make([]byte, int(header[4])+2)
+		if _, err := io.ReadFull(reader, destination); err != nil {
+			return ""
+		}
+		_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		_, _ = conn.Write([]byte("hello"))
+		return string(destination[:header[4]])
+	})
+
+	resolutions := dns.NewResolutions()
+	resolutions.RecordResolution("example.com.", net.ParseIP("192.0.2.10"), 60)
+	dialer, err := NewDialer(&types.Configuration{
+		OutboundProxy: &types.OutboundProxy{URL: "socks5://" + ln.Addr().String()},
+	}, resolutions)
+	assert.NoError(t, err)
+
+	conn, err := dialer.Dial(net.ParseIP("192.0.2.10"), 443)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "example.com", <-destinations)
+	data, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestNoProxy(t *testing.T) {
+	resolutions := dns.NewResolutions()
+	resolutions.RecordResolution("www.internal.example.com.", net.ParseIP("192.0.2.20"), 60)
+	resolutions.RecordResolution("www.example.org.", net.ParseIP("192.0.2.30"), 60)
+	dialer, err := NewDialer(&types.Configuration{
+		OutboundProxy: &types.OutboundProxy{
+			URL:     "http://proxy.example.com:3128",
+			NoProxy: []string{"10.0.0.0/8", "192.0.2.1", ".internal.example.com"},
+		},
+	}, resolutions)
+	assert.NoError(t, err)
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.0.2.1", "192.0.2.20"} {
+		assert.True(t, dialer.direct(net.ParseIP(ip), resolutions.Names(net.ParseIP(ip))), ip)
+	}
+	for _, ip := range []string{"192.0.2.2", "192.0.2.30"} {
+		assert.False(t, dialer.direct(net.ParseIP(ip), resolutions.Names(net.ParseIP(ip))), ip)
+	}
+
+	_, err = NewDialer(&types.Configuration{OutboundProxy: &types.OutboundProxy{URL: "ftp://proxy.example.com"}}, resolutions)
+	assert.Error(t, err)
+}
@@ -0,0 +1,277 @@
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/icmp"
+	xipv4 "golang.org/x/net/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	// ICMPConnTrackTimeout is the time after which an idle ping is forgotten
+	ICMPConnTrackTimeout = 30 * time.Second
+	// ICMPConnTrackMax is the maximum number of host sockets opened for the echo sessions.
+	// When it is reached, the least recently used session is closed.
+	ICMPConnTrackMax = 256
+
+	icmpBufSize = 65535
+)
+
+// An echo session of the guest, identified like the kernel does for ping sockets.
+type icmpConnTrackKey struct {
+	source      tcpip.Address
+	destination tcpip.Address
+	id          uint16
+}
+
+type icmpConnTrackEntry struct {
+	conn     *icmp.PacketConn
+	lastUsed time.Time
+}
+
+// ICMPForwarder relays the echo requests sent by the virtual machines to external
+// addresses with unprivileged ICMP sockets of the host, and injects the replies
+// back in the stack.
+type ICMPForwarder struct {
+	stack    *stack.Stack
+	endpoint tcpip.Endpoint
+
+	nat     map[tcpip.Address]tcpip.Address
+	natLock *sync.Mutex
+	// filters the destinations of the echo requests
+	allowed func(destination tcpip.Address) bool
+
+	connTrackTable map[icmpConnTrackKey]*icmpConnTrackEntry
+	connTrackMax   int
+	connTrackLock  sync.Mutex
+}
+
+func ICMP(s *stack.Stack, nat map[tcpip.Address]tcpip.Address, natLock *sync.Mutex, allowed func(destination tcpip.Address) bool) (*ICMPForwarder, error) {
+	// Replies are written with their IP header to keep the address of the remote host as source
+	var wq waiter.Queue
+	ep, err := s.NewRawEndpoint(header.ICMPv4ProtocolNumber, ipv4.ProtocolNumber, &wq, false)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+	return &ICMPForwarder{
+		stack:          s,
+		endpoint:       ep,
+		nat:            nat,
+		natLock:        natLock,
+		allowed:        allowed,
+		connTrackTable: make(map[icmpConnTrackKey]*icmpConnTrackEntry),
+		connTrackMax:   ICMPConnTrackMax,
+	}, nil
+}
+
+// HandlePacket forwards IPv4 echo requests that are not for the gateway itself.
+// It must be called before the packet is given to the stack, which would answer
+// on behalf of any address since the NIC is in promiscuous mode.
+// It returns false when the packet was not handled and must go through the stack.
+func (f *ICMPForwarder) HandlePacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) bool {
+	if protocol != ipv4.ProtocolNumber {
+		return false
+	}
+	// most packets are TCP and UDP, they are not copied
+	hdr, ok := pkt.Data().PullUp(header.IPv4MinimumSize)
+	if !ok || header.IPv4(hdr).TransportProtocol() != header.ICMPv4ProtocolNumber {
+		return false
+	}
+	view := pkt.ToView()
+	defer view.Release()
+	ip := header.IPv4(view.AsSlice())
+	if !ip.IsValid(len(ip)) || ip.TransportProtocol() != header.ICMPv4ProtocolNumber ||
+		ip.More() || ip.FragmentOffset() != 0 {
+		return false
+	}
+	echo := header.ICMPv4(ip.Payload())
+	if len(echo) < header.ICMPv4MinimumSize || echo.Type() != header.ICMPv4Echo || echo.Code() != 0 {
+		return false
+	}
+
+	destination := ip.DestinationAddress()
+	if destination == header.IPv4Broadcast || header.IsV4MulticastAddress(destination) ||
+		linkLocal().Contains(destination) || f.isLocal(destination) {
+		return false
+	}
+
+	if !f.allowed(destination) {
+		// dropped, the stack must not answer on behalf of the destination
+		log.Debugf("firewall: ping from %s to %s denied", ip.SourceAddress(), destination)
+		return true
+	}
+
+	key := icmpConnTrackKey{
+		source:      ip.SourceAddress(),
+		destination: destination,
+		id:          echo.Ident(),
+	}
+	conn, err := f.conn(key)
+	if err != nil {
+		log.Debugf("cannot forward ping to %s, answering from the gateway: %v", destination, err)
+		return false
+	}
+
+	request, err := (&icmp.Message{
+		Type: xipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{
+			ID:   int(echo.Ident()),
+			Seq:  int(echo.Sequence()),
+			Data: echo.Payload(),
+		},
+	}).Marshal(nil)
+	if err != nil {
+		log.Errorf("cannot build echo request: %v", err)
+		return true
+	}
+
+	f.natLock.Lock()
+	if replaced, ok := f.nat[destination]; ok {
+		destination = replaced
+	}
+	f.natLock.Unlock()
+
+	_ = conn.SetReadDeadline(time.Now().Add(ICMPConnTrackTimeout))
+	if _, err := conn.WriteTo(request, &net.UDPAddr{IP: net.IP(destination.AsSlice())}); err != nil {
+		log.Debugf("cannot send echo request to %s: %v", destination, err)
+	}
+	return true
+}
+
+// isLocal returns whether the address is assigned to the gateway.
+// CheckLocalAddress of the stack can't be used since spoofing is enabled.
+func (f *ICMPForwarder) isLocal(address tcpip.Address) bool {
+	for _, addresses := range f.stack.AllAddresses() {
+		for _, candidate := range addresses {
+			if candidate.AddressWithPrefix.Address == address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// conn returns the host socket of the echo session, creating it if needed.
+func (f *ICMPForwarder) conn(key icmpConnTrackKey) (*icmp.PacketConn, error) {
+	f.connTrackLock.Lock()
+	defer f.connTrackLock.Unlock()
+
+	if entry, ok := f.connTrackTable[key]; ok {
+		entry.lastUsed = time.Now()
+		return entry.conn, nil
+	}
+	if len(f.connTrackTable) >= f.connTrackMax {
+		f.evictOldest()
+	}
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	f.connTrackTable[key] = &icmpConnTrackEntry{
+		conn:     conn,
+		lastUsed: time.Now(),
+	}
+	go f.replyLoop(key, conn)
+	return conn, nil
+}
+
+// evictOldest closes the least recently used echo session.
+// connTrackLock must be held.
+func (f *ICMPForwarder) evictOldest() {
+	var (
+		oldestKey icmpConnTrackKey
+		oldest    *icmpConnTrackEntry
+	)
+	for key, entry := range f.connTrackTable {
+		if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	log.Debugf("too many pings, closing the session from %s to %s", oldestKey.source, oldestKey.destination)
+	delete(f.connTrackTable, oldestKey)
+	oldest.conn.Close()
+}
+
+func (f *ICMPForwarder) replyLoop(key icmpConnTrackKey, conn *icmp.PacketConn) {
+	defer func() {
+		f.connTrackLock.Lock()
+		// the session may have been evicted and opened again since
+		if entry, ok := f.connTrackTable[key]; ok && entry.conn == conn {
+			delete(f.connTrackTable, key)
+		}
+		f.connTrackLock.Unlock()
+		conn.Close()
+	}()
+
+	readBuf := make([]byte, icmpBufSize)
+	for {
+		n, _, err := conn.ReadFrom(readBuf)
+		if err != nil {
+			var netErr net.Error
+			if !errors.Is(err, net.ErrClosed) && (!errors.As(err, &netErr) || !netErr.Timeout()) {
+				log.Debugf("cannot read echo reply: %v", err)
+			}
+			return
+		}
+		msg, err := icmp.ParseMessage(1, readBuf[:n])
+		if err != nil || msg.Type != xipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok {
+			continue
+		}
+		if err := f.reply(key, uint16(echo.Seq), echo.Data); err != nil {
+			log.Debugf("cannot forward echo reply to %s: %v", key.source, err)
+		}
+	}
+}
+
+// reply writes an echo reply to the guest, as if it was sent by the destination of the request.
+func (f *ICMPForwarder) reply(key icmpConnTrackKey, seq uint16, data []byte) error {
+	pkt := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(data))
+
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		TTL:         ipv4.DefaultTTL,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     key.destination,
+		DstAddr:     key.source,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	// The ID was possibly rewritten by the host kernel, restore the one of the guest
+	echo := header.ICMPv4(ip.Payload())
+	echo.SetType(header.ICMPv4EchoReply)
+	echo.SetIdent(key.id)
+	echo.SetSequence(seq)
+	copy(echo.Payload(), data)
+	echo.SetChecksum(^checksum.Checksum(echo, 0))
+
+	var r bytes.Reader
+	r.Reset(pkt)
+	if _, err := f.endpoint.Write(&r, tcpip.WriteOptions{
+		To: &tcpip.FullAddress{
+			NIC:  1,
+			Addr: key.source,
+		},
+	}); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
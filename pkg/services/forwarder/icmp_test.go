@@ -0,0 +1,192 @@
+package forwarder
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/icmp"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/raw"
+)
+
+var (
+	guestIP   = tcpip.AddrFrom4Slice(net.ParseIP("192.168.127.2").To4())
+	gatewayIP = tcpip.AddrFrom4Slice(net.ParseIP("192.168.127.1").To4())
+	hostIP    = tcpip.AddrFrom4Slice(net.ParseIP("192.168.127.254").To4())
+)
+
+// capture records the frames sent by the gateway to the virtual machines.
+type capture chan stack.PacketBufferPtr
+
+func (c capture) DeliverNetworkPacket(_ tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	pkt.IncRef()
+	c <- pkt
+}
+
+func icmpStack(t *testing.T) (*stack.Stack, capture) {
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		RawFactory:       raw.EndpointFactory{},
+	})
+	ep, err := tap.NewLinkEndpoint(false, 1500, "5a:94:ef:e4:0c:dd", "192.168.127.1", nil)
+	assert.NoError(t, err)
+	frames := make(capture, 10)
+	ep.Connect(frames)
+	assert.Nil(t, s.CreateNIC(1, ep))
+	assert.Nil(t, s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: gatewayIP.WithPrefix(),
+	}, stack.AddressProperties{}))
+	assert.Nil(t, s.AddStaticNeighbor(1, ipv4.ProtocolNumber, guestIP, "\x5a\x94\xef\xe4\x0c\xee"))
+	s.SetSpoofing(1, true)
+	s.SetPromiscuousMode(1, true)
+	subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom4Slice([]byte{192, 168, 127, 0}), tcpip.MaskFromBytes([]byte{255, 255, 255, 0}))
+	s.SetRouteTable([]tcpip.Route{{Destination: subnet, NIC: 1}})
+	t.Cleanup(s.Close)
+	return s, frames
+}
+
+func ipv4Packet(protocol tcpip.TransportProtocolNumber, src, dst tcpip.Address, payload []byte) stack.PacketBufferPtr {
+	pkt := make([]byte, header.IPv4MinimumSize+len(payload))
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    uint8(protocol),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(ip.Payload(), payload)
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(pkt),
+	})
+}
+
+func echoRequest(id, seq uint16, data []byte) []byte {
+	echo := header.ICMPv4(make([]byte, header.ICMPv4MinimumSize+len(data)))
+	echo.SetType(header.ICMPv4Echo)
+	echo.SetIdent(id)
+	echo.SetSequence(seq)
+	copy(echo.Payload(), data)
+	echo.SetChecksum(^checksum.Checksum(echo, 0))
+	return echo
+}
+
+func TestICMPForwarder(t *testing.T) {
+	// unprivileged ICMP sockets depend on net.ipv4.ping_group_range
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		t.Skipf("cannot open ICMP socket: %v", err)
+	}
+	conn.Close()
+
+	s, frames := icmpStack(t)
+	var natLock sync.Mutex
+	nat := map[tcpip.Address]tcpip.Address{hostIP: tcpip.AddrFrom4Slice(net.ParseIP("127.0.0.1").To4())}
+	forwarder, err := ICMP(s, nat, &natLock, func(tcpip.Address) bool { return true })
+	assert.NoError(t, err)
+
+	// the gateway answers itself
+	pkt := ipv4Packet(header.ICMPv4ProtocolNumber, guestIP, gatewayIP, echoRequest(42, 1, []byte("ping")))
+	assert.False(t, forwarder.HandlePacket(ipv4.ProtocolNumber, pkt))
+	pkt.DecRef()
+
+	// the virtual IP is translated to the host loopback, the reply comes from the virtual IP
+	pkt = ipv4Packet(header.ICMPv4ProtocolNumber, guestIP, hostIP, echoRequest(42, 7, []byte("ping")))
+	assert.True(t, forwarder.HandlePacket(ipv4.ProtocolNumber, pkt))
+	pkt.DecRef()
+
+	var reply stack.PacketBufferPtr
+	select {
+	case reply = <-frames:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo reply")
+	}
+	defer reply.DecRef()
+	view := reply.ToView()
+	defer view.Release()
+	view.TrimFront(header.EthernetMinimumSize)
+	ip := header.IPv4(view.AsSlice())
+	assert.Equal(t, hostIP, ip.SourceAddress())
+	assert.Equal(t, guestIP, ip.DestinationAddress())
+	echo := header.ICMPv4(ip.Payload())
+	assert.Equal(t, header.ICMPv4EchoReply, echo.Type())
+	assert.Equal(t, uint16(42), echo.Ident())
+	assert.Equal(t, uint16(7), echo.Sequence())
+	assert.Equal(t, []byte("ping"), echo.Payload())
+}
+
+func TestICMPForwarderIgnoresOtherProtocols(t *testing.T) {
+	s, _ := icmpStack(t)
+	var natLock sync.Mutex
+	forwarder, err := ICMP(s, map[tcpip.Address]tcpip.Address{}, &natLock, func(tcpip.Address) bool { return true })
+	assert.NoError(t, err)
+
+	pkt := ipv4Packet(header.TCPProtocolNumber, guestIP, hostIP, make([]byte, header.TCPMinimumSize))
+	defer pkt.DecRef()
+	assert.False(t, forwarder.HandlePacket(ipv4.ProtocolNumber, pkt))
+}
+
+func TestICMPForwarderFirewall(t *testing.T) {
+	s, frames := icmpStack(t)
+	var natLock sync.Mutex
+	forwarder, err := ICMP(s, map[tcpip.Address]tcpip.Address{}, &natLock, func(destination tcpip.Address) bool {
+		return destination != hostIP
+	})
+	assert.NoError(t, err)
+
+	// dropped, neither forwarded nor answered by the stack
+	pkt := ipv4Packet(header.ICMPv4ProtocolNumber, guestIP, hostIP, echoRequest(42, 1, []byte("ping")))
+	defer pkt.DecRef()
+	assert.True(t, forwarder.HandlePacket(ipv4.ProtocolNumber, pkt))
+	assert.Empty(t, frames)
+}
+
+func TestICMPForwarderEvictsOldestSession(t *testing.T) {
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		t.Skipf("cannot open ICMP socket: %v", err)
+	}
+	conn.Close()
+
+	s, _ := icmpStack(t)
+	var natLock sync.Mutex
+	forwarder, err := ICMP(s, map[tcpip.Address]tcpip.Address{}, &natLock, func(tcpip.Address) bool { return true })
+	assert.NoError(t, err)
+	forwarder.connTrackMax = 2
+
+	first := icmpConnTrackKey{source: guestIP, destination: hostIP, id: 1}
+	second := icmpConnTrackKey{source: guestIP, destination: hostIP, id: 2}
+	third := icmpConnTrackKey{source: guestIP, destination: hostIP, id: 3}
+
+	_, err = forwarder.conn(first)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	_, err = forwarder.conn(second)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	// the first session is used again, the second one is now the oldest
+	_, err = forwarder.conn(first)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	_, err = forwarder.conn(third)
+	assert.NoError(t, err)
+
+	forwarder.connTrackLock.Lock()
+	defer forwarder.connTrackLock.Unlock()
+	assert.Len(t, forwarder.connTrackTable, 2)
+	assert.Contains(t, forwarder.connTrackTable, first)
+	assert.NotContains(t, forwarder.connTrackTable, second)
+	assert.Contains(t, forwarder.connTrackTable, third)
+}
@@ -12,7 +12,6 @@ import (
 	"os"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/sshclient"
@@ -21,6 +20,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"inet.af/tcpproxy"
 )
@@ -33,10 +33,11 @@ type PortsForwarder struct {
 }
 
 type proxy struct {
-	Local      string `json:"local"`
-	Remote     string `json:"remote"`
-	Protocol   string `json:"protocol"`
-	underlying io.Closer
+	Local         string `json:"local"`
+	Remote        string `json:"remote"`
+	Protocol      string `json:"protocol"`
+	ProxyProtocol int    `json:"proxyProtocol,omitempty"`
+	underlying    io.Closer
 }
 
 type gonetDialer struct {
@@ -49,7 +50,7 @@ func (d *gonetDialer) DialContextTCP(ctx context.Context, addr string) (conn net
 		return nil, err
 	}
 
-	return gonet.DialContextTCP(ctx, d.stack, address, ipv4.ProtocolNumber)
+	return gonet.DialContextTCP(ctx, d.stack, address, networkProtocol(address))
 }
 
 type CloseWrapper func() error
@@ -66,11 +67,20 @@ func NewPortsForwarder(s *stack.Stack) *PortsForwarder {
 }
 
 func (f *PortsForwarder) Expose(protocol types.TransportProtocol, local, remote string) error {
+	return f.ExposeWithProxyProtocol(protocol, local, remote, 0)
+}
+
+// ExposeWithProxyProtocol is like Expose, but each connection to the remote service starts with a PROXY protocol header
+// (version 1 or 2) carrying the address of the host-side client. Only TCP and unix sockets forwards support it.
+func (f *PortsForwarder) ExposeWithProxyProtocol(protocol types.TransportProtocol, local, remote string, proxyProtocol int) error {
 	f.proxiesLock.Lock()
 	defer f.proxiesLock.Unlock()
 	if _, ok := f.proxies[local]; ok {
 		return errors.New("proxy already running")
 	}
+	if err := validProxyProtocolVersion(proxyProtocol); err != nil {
+		return err
+	}
 
 	switch protocol {
 	case types.UNIX, types.NPIPE:
@@ -146,7 +156,7 @@ func (f *PortsForwarder) Expose(protocol types.TransportProtocol, local, remote
 			}
 
 			dialFn = func(ctx context.Context, network, addr string) (conn net.Conn, e error) {
-				return gonet.DialContextTCP(ctx, f.stack, address, ipv4.ProtocolNumber)
+				return gonet.DialContextTCP(ctx, f.stack, address, networkProtocol(address))
 			}
 
 		default:
@@ -173,10 +183,7 @@ func (f *PortsForwarder) Expose(protocol types.TransportProtocol, local, remote
 				return sshclient.ListenNpipe(npipeURI)
 			}
 		}
-		p.AddRoute(local, &tcpproxy.DialProxy{
-			Addr:        remoteAddr,
-			DialContext: dialFn,
-		})
+		p.AddRoute(local, target(remoteAddr, proxyProtocol, dialFn))
 		if err := p.Start(); err != nil {
 			return err
 		}
@@ -186,9 +193,10 @@ func (f *PortsForwarder) Expose(protocol types.TransportProtocol, local, remote
 			}
 		}()
 		f.proxies[key(protocol, local)] = proxy{
-			Protocol: string(protocol),
-			Local:    local,
-			Remote:   remote,
+			Protocol:      string(protocol),
+			Local:         local,
+			Remote:        remote,
+			ProxyProtocol: proxyProtocol,
 			underlying: CloseWrapper(func() error {
 				if cleanup != nil {
 					cleanup()
@@ -197,6 +205,9 @@ func (f *PortsForwarder) Expose(protocol types.TransportProtocol, local, remote
 			}),
 		}
 	case types.UDP:
+		if proxyProtocol != 0 {
+			return errors.New("PROXY protocol is not supported for udp forwards")
+		}
 		address, err := tcpipAddress(1, remote)
 		if err != nil {
 			return err
@@ -211,7 +222,7 @@ func (f *PortsForwarder) Expose(protocol types.TransportProtocol, local, remote
 			return err
 		}
 		p, err := NewUDPProxy(listener, func() (net.Conn, error) {
-			return gonet.DialUDP(f.stack, nil, &address, ipv4.ProtocolNumber)
+			return gonet.DialUDP(f.stack, nil, &address, networkProtocol(address))
 		})
 		if err != nil {
 			return err
@@ -230,12 +241,9 @@ func (f *PortsForwarder) Expose(protocol types.TransportProtocol, local, remote
 		}
 
 		var p tcpproxy.Proxy
-		p.AddRoute(local, &tcpproxy.DialProxy{
-			Addr: remote,
-			DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, e error) {
-				return gonet.DialContextTCP(ctx, f.stack, address, ipv4.ProtocolNumber)
-			},
-		})
+		p.AddRoute(local, target(remote, proxyProtocol, func(ctx context.Context, network, addr string) (conn net.Conn, e error) {
+			return gonet.DialContextTCP(ctx, f.stack, address, networkProtocol(address))
+		}))
 		if err := p.Start(); err != nil {
 			return err
 		}
@@ -245,10 +253,11 @@ func (f *PortsForwarder) Expose(protocol types.TransportProtocol, local, remote
 			}
 		}()
 		f.proxies[key(protocol, local)] = proxy{
-			Protocol:   "tcp",
-			Local:      local,
-			Remote:     remote,
-			underlying: &p,
+			Protocol:      "tcp",
+			Local:         local,
+			Remote:        remote,
+			ProxyProtocol: proxyProtocol,
+			underlying:    &p,
 		}
 	default:
 		return fmt.Errorf("unknown protocol %s", protocol)
@@ -315,7 +324,7 @@ func (f *PortsForwarder) Mux() http.Handler {
 			}
 		}
 
-		if err := f.Expose(req.Protocol, req.Local, remoteAddr); err != nil {
+		if err := f.ExposeWithProxyProtocol(req.Protocol, req.Local, remoteAddr, req.ProxyProtocol); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -345,7 +354,7 @@ func (f *PortsForwarder) Mux() http.Handler {
 
 // if the request doesn't have an IP in the remote field, use the IP from the incoming http request.
 func remote(req types.ExposeRequest, ip string) (string, error) {
-	remoteIP, _, err := net.SplitHostPort(req.Remote)
+	remoteIP, remotePort, err := net.SplitHostPort(req.Remote)
 	if err != nil {
 		return "", err
 	}
@@ -354,7 +363,7 @@ func remote(req types.ExposeRequest, ip string) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		return fmt.Sprintf("%s%s", host, req.Remote), nil
+		return net.JoinHostPort(host, remotePort), nil
 	}
 	return req.Remote, nil
 }
@@ -371,22 +380,39 @@ func firstValueOrEmpty(x []string) string {
 func tcpipAddress(nicID tcpip.NICID, remote string) (address tcpip.FullAddress, err error) {
 
 	// build the address manual way
-	split := strings.Split(remote, ":")
-	if len(split) != 2 {
+	host, portString, err := net.SplitHostPort(remote)
+	if err != nil {
 		return address, errors.New("invalid remote addr")
 	}
 
-	port, err := strconv.Atoi(split[1])
+	port, err := strconv.Atoi(portString)
 	if err != nil {
 		return address, err
 
 	}
 
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return address, errors.New("invalid remote addr")
+	}
+
 	address = tcpip.FullAddress{
 		NIC:  nicID,
-		Addr: tcpip.AddrFrom4Slice(net.ParseIP(split[0]).To4()),
 		Port: uint16(port),
 	}
+	if ip4 := ip.To4(); ip4 != nil {
+		address.Addr = tcpip.AddrFrom4Slice(ip4)
+	} else {
+		address.Addr = tcpip.AddrFrom16Slice(ip)
+	}
 
 	return address, err
 }
+
+// helper function to pick the network protocol matching an address
+func networkProtocol(address tcpip.FullAddress) tcpip.NetworkProtocolNumber {
+	if address.Addr.Len() == net.IPv4len {
+		return ipv4.ProtocolNumber
+	}
+	return ipv6.ProtocolNumber
+}
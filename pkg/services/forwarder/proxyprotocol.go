@@ -0,0 +1,138 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"inet.af/tcpproxy"
+)
+
+// signature of the binary PROXY protocol header
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// size of each unix socket path in the binary PROXY protocol header, like sun_path
+const proxyProtocolV2UnixPathLen = 108
+
+func validProxyProtocolVersion(version int) error {
+	if version < 0 || version > 2 {
+		return fmt.Errorf("PROXY protocol version %d not supported", version)
+	}
+	return nil
+}
+
+// proxyProtocolTarget dials the remote service and sends a PROXY protocol header with the addresses of the host-side
+// connection before relaying it.
+type proxyProtocolTarget struct {
+	addr        string
+	version     int
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (t *proxyProtocolTarget) HandleConn(src net.Conn) {
+	dp := &tcpproxy.DialProxy{
+		Addr: t.addr,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := t.dialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeProxyHeader(conn, t.version, src.RemoteAddr(), src.LocalAddr()); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+	dp.HandleConn(src)
+}
+
+// target returns the route of a forward, which sends a PROXY protocol header when version is not 0.
+func target(addr string, version int, dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) tcpproxy.Target {
+	if version == 0 {
+		return &tcpproxy.DialProxy{
+			Addr:        addr,
+			DialContext: dialContext,
+		}
+	}
+	return &proxyProtocolTarget{
+		addr:        addr,
+		version:     version,
+		dialContext: dialContext,
+	}
+}
+
+// writeProxyHeader writes the header of the PROXY protocol (version 1 or 2) for a connection from src to dst.
+// Version 1 has no unix socket addresses, they are sent as unknown like any address which is not TCP.
+// Version 2 sends them as AF_UNIX, paths longer than 108 bytes are truncated.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+
+	srcIP, dstIP := net.IP(nil), net.IP(nil)
+	if known {
+		srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+		}
+		known = srcIP != nil && dstIP != nil
+	}
+
+	switch version {
+	case 1:
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		family := "TCP4"
+		if len(srcIP) == net.IPv6len {
+			family = "TCP6"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcAddr.Port, dstAddr.Port)
+		return err
+	case 2:
+		var buf bytes.Buffer
+		buf.Write(proxyProtocolV2Signature)
+		// version 2, PROXY command
+		buf.WriteByte(0x21)
+		srcUnix, srcUnixOK := src.(*net.UnixAddr)
+		dstUnix, dstUnixOK := dst.(*net.UnixAddr)
+		if srcUnixOK && dstUnixOK {
+			// unix stream socket
+			buf.WriteByte(0x31)
+			_ = binary.Write(&buf, binary.BigEndian, uint16(2*proxyProtocolV2UnixPathLen))
+			for _, name := range []string{srcUnix.Name, dstUnix.Name} {
+				path := make([]byte, proxyProtocolV2UnixPathLen)
+				copy(path, name)
+				buf.Write(path)
+			}
+			_, err := w.Write(buf.Bytes())
+			return err
+		}
+		if !known {
+			// AF_UNSPEC, the receiver uses the addresses of the connection
+			buf.Write([]byte{0x00, 0x00, 0x00})
+			_, err := w.Write(buf.Bytes())
+			return err
+		}
+		// TCP over IPv4 or IPv6
+		family := byte(0x11)
+		if len(srcIP) == net.IPv6len {
+			family = 0x21
+		}
+		buf.WriteByte(family)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(srcAddr.Port))
+		_ = binary.Write(&buf, binary.BigEndian, uint16(dstAddr.Port))
+		_, err := w.Write(buf.Bytes())
+		return err
+	default:
+		return validProxyProtocolVersion(version)
+	}
+}
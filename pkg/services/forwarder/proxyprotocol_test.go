@@ -0,0 +1,106 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"inet.af/tcpproxy"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeProxyHeader(&buf, 1,
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234},
+		&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}))
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 127.0.0.1 51234 8080\r\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 1,
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234},
+		&net.TCPAddr{IP: net.ParseIP("::1"), Port: 8080}))
+	assert.Equal(t, "PROXY TCP6 2001:db8::1 ::1 51234 8080\r\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 1, &net.UnixAddr{Net: "unix"}, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}))
+	assert.Equal(t, "PROXY UNKNOWN\r\n", buf.String())
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeProxyHeader(&buf, 2,
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 0x1234},
+		&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}))
+	expected := append([]byte{}, proxyProtocolV2Signature...)
+	expected = append(expected, 0x21, 0x11, 0x00, 12, 192, 0, 2, 1, 127, 0, 0, 1, 0x12, 0x34, 0x00, 80)
+	assert.Equal(t, expected, buf.Bytes())
+
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 2,
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1},
+		&net.TCPAddr{IP: net.ParseIP("::1"), Port: 2}))
+	assert.Equal(t, byte(0x21), buf.Bytes()[13])
+	assert.Equal(t, []byte{0x00, 36}, buf.Bytes()[14:16])
+	assert.Equal(t, 16+36, buf.Len())
+
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 2, &net.UnixAddr{Net: "unix"}, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}))
+	expected = append([]byte{}, proxyProtocolV2Signature...)
+	expected = append(expected, 0x21, 0x31, 0x00, 216)
+	expected = append(expected, make([]byte, 108)...)
+	expected = append(expected, append([]byte("/tmp/sock"), make([]byte, 108-len("/tmp/sock"))...)...)
+	assert.Equal(t, expected, buf.Bytes())
+
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 2, &net.UnixAddr{Net: "unix"}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}))
+	expected = append([]byte{}, proxyProtocolV2Signature...)
+	expected = append(expected, 0x21, 0x00, 0x00, 0x00)
+	assert.Equal(t, expected, buf.Bytes())
+
+	assert.Error(t, writeProxyHeader(&buf, 3, nil, nil))
+}
+
+func TestProxyProtocolTarget(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		header, _ := reader.ReadString('\n')
+		data, _ := reader.ReadString('\n')
+		received <- header + data
+	}()
+
+	var p tcpproxy.Proxy
+	p.AddRoute("127.0.0.1:0", target(backend.Addr().String(), 1, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	p.ListenFunc = func(_, _ string) (net.Listener, error) {
+		return ln, nil
+	}
+	assert.NoError(t, p.Start())
+	defer p.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	_, err = io.WriteString(client, "hello\n")
+	assert.NoError(t, err)
+
+	clientAddr := client.LocalAddr().(*net.TCPAddr)
+	serverAddr := ln.Addr().(*net.TCPAddr)
+	assert.Equal(t, "PROXY TCP4 127.0.0.1 127.0.0.1 "+strconv.Itoa(clientAddr.Port)+" "+strconv.Itoa(serverAddr.Port)+"\r\nhello\n", <-received)
+}
@@ -2,13 +2,13 @@ package forwarder
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/waiter"
@@ -18,10 +18,15 @@ import (
 const linkLocalSubnet = "169.254.0.0/16"
 
 func TCP(s *stack.Stack, nat map[tcpip.Address]tcpip.Address, natLock *sync.Mutex) *tcp.Forwarder {
+	return TCPWithDialer(s, nat, natLock, &Dialer{})
+}
+
+// TCPWithDialer forwards the TCP connections of the virtual machines, opening them on the host with the dialer.
+func TCPWithDialer(s *stack.Stack, nat map[tcpip.Address]tcpip.Address, natLock *sync.Mutex, dialer *Dialer) *tcp.Forwarder {
 	return tcp.NewForwarder(s, 0, 10, func(r *tcp.ForwarderRequest) {
 		localAddress := r.ID().LocalAddress
 
-		if linkLocal().Contains(localAddress) {
+		if linkLocal().Contains(localAddress) || header.IsV6LinkLocalUnicastAddress(localAddress) {
 			r.Complete(true)
 			return
 		}
@@ -31,9 +36,9 @@ func TCP(s *stack.Stack, nat map[tcpip.Address]tcpip.Address, natLock *sync.Mute
 			localAddress = replaced
 		}
 		natLock.Unlock()
-		outbound, err := net.Dial("tcp", fmt.Sprintf("%s:%d", localAddress, r.ID().LocalPort))
+		outbound, err := dialer.Dial(net.IP(localAddress.AsSlice()), r.ID().LocalPort)
 		if err != nil {
-			log.Tracef("net.Dial() = %v", err)
+			log.Tracef("dialer.Dial() = %v", err)
 			r.Complete(true)
 			return
 		}
@@ -1,8 +1,8 @@
 package forwarder
 
 import (
-	"fmt"
 	"net"
+	"strconv"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -18,7 +18,8 @@ func UDP(s *stack.Stack, nat map[tcpip.Address]tcpip.Address, natLock *sync.Mute
 	return udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
 		localAddress := r.ID().LocalAddress
 
-		if linkLocal().Contains(localAddress) || localAddress == header.IPv4Broadcast {
+		if linkLocal().Contains(localAddress) || localAddress == header.IPv4Broadcast ||
+			header.IsV6LinkLocalUnicastAddress(localAddress) || header.IsV6MulticastAddress(localAddress) {
 			return
 		}
 
@@ -36,7 +37,7 @@ func UDP(s *stack.Stack, nat map[tcpip.Address]tcpip.Address, natLock *sync.Mute
 		}
 
 		p, _ := NewUDPProxy(&autoStoppingListener{underlying: gonet.NewUDPConn(s, &wq, ep)}, func() (net.Conn, error) {
-			return net.Dial("udp", fmt.Sprintf("%s:%d", localAddress, r.ID().LocalPort))
+			return net.Dial("udp", net.JoinHostPort(localAddress.String(), strconv.Itoa(int(r.ID().LocalPort))))
 		})
 		go p.Run()
 	})
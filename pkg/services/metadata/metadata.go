@@ -0,0 +1,315 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// IP is the well-known address of the metadata services of the clouds.
+const IP = "169.254.169.254"
+
+// Server answers to the metadata requests of the virtual machines, with the EC2 and OpenStack paths.
+// Virtual machines are identified by the MAC address of the DHCP lease of their source IP. Only port security
+// prevents a VM from using the IP of another one, it is required to give instances their own metadata.
+type Server struct {
+	listener     net.Listener
+	ipPool       *tap.IPPool
+	portSecurity bool
+
+	defaultInstance types.MetadataInstance
+	// indexed by MAC address
+	instances     map[string]types.MetadataInstance
+	instancesLock sync.RWMutex
+}
+
+func New(configuration *types.Configuration, s *stack.Stack, ipPool *tap.IPPool) (*Server, error) {
+	addr := tcpip.AddrFrom4Slice(net.ParseIP(IP).To4())
+	if err := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: addr.WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		return nil, errors.New(err.String())
+	}
+	ln, err := gonet.ListenTCP(s, tcpip.FullAddress{
+		NIC:  1,
+		Addr: addr,
+		Port: 80,
+	}, ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		listener:     ln,
+		ipPool:       ipPool,
+		portSecurity: configuration.PortSecurity,
+		instances:    make(map[string]types.MetadataInstance),
+	}
+	if configuration.Metadata != nil {
+		server.defaultInstance = configuration.Metadata.Default
+		for _, instance := range configuration.Metadata.Instances {
+			if err := server.setInstance(instance); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return server, nil
+}
+
+func (s *Server) Serve() error {
+	return http.Serve(s.listener, s.handler())
+}
+
+// instance returns the metadata of the virtual machine sending the request, with the defaults filled in.
+func (s *Server) instance(r *http.Request) (types.MetadataInstance, string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return types.MetadataInstance{}, "", err
+	}
+	mac, ok := s.ipPool.Leases()[host]
+	if !ok {
+		return types.MetadataInstance{}, "", fmt.Errorf("no lease for %s", host)
+	}
+
+	s.instancesLock.RLock()
+	instance, ok := s.instances[mac]
+	if !ok {
+		instance = s.defaultInstance
+	}
+	s.instancesLock.RUnlock()
+
+	if instance.InstanceID == "" {
+		instance.InstanceID = "i-" + strings.ReplaceAll(mac, ":", "")
+	}
+	if instance.Hostname == "" {
+		var hostnames []string
+		for hostname, ip := range s.ipPool.Hostnames() {
+			if ip == host {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		if len(hostnames) > 0 {
+			sort.Strings(hostnames)
+			instance.Hostname = hostnames[0]
+		}
+	}
+	if instance.Hostname == "" {
+		instance.Hostname = strings.ReplaceAll(host, ".", "-")
+	}
+	instance.MAC = mac
+	return instance, host, nil
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	// EC2, the version of the API, latest or a date like 2009-04-04, is ignored
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintln(w, "latest")
+			return
+		}
+		version, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if version != "latest" && !isDate(version) {
+			http.NotFound(w, r)
+			return
+		}
+		instance, ip, err := s.instance(r)
+		if err != nil {
+			log.Debugf("metadata: %v", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		serveEC2(w, r, path, instance, ip)
+	})
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		// IMDSv2 session token, requests are not authenticated
+		if r.Method != http.MethodPut {
+			http.Error(w, "put only", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprint(w, "gvisor-tap-vsock")
+	})
+
+	mux.HandleFunc("/openstack/", func(w http.ResponseWriter, r *http.Request) {
+		instance, _, err := s.instance(r)
+		if err != nil {
+			log.Debugf("metadata: %v", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		serveOpenStack(w, r, strings.TrimPrefix(r.URL.Path, "/openstack/"), instance)
+	})
+	return mux
+}
+
+// isDate returns whether the version of the EC2 API is a date like 2009-04-04.
+func isDate(version string) bool {
+	_, err := time.Parse("2006-01-02", version)
+	return err == nil
+}
+
+func serveEC2(w http.ResponseWriter, r *http.Request, path string, instance types.MetadataInstance, ip string) {
+	switch path {
+	case "":
+		fmt.Fprint(w, "meta-data/\nuser-data")
+	case "user-data":
+		serveUserData(w, r, instance)
+	case "meta-data", "meta-data/":
+		fmt.Fprint(w, "hostname\ninstance-id\nlocal-hostname\nlocal-ipv4\nmac\npublic-keys/")
+	case "meta-data/instance-id":
+		fmt.Fprint(w, instance.InstanceID)
+	case "meta-data/hostname", "meta-data/local-hostname":
+		fmt.Fprint(w, instance.Hostname)
+	case "meta-data/local-ipv4":
+		fmt.Fprint(w, ip)
+	case "meta-data/mac":
+		fmt.Fprint(w, instance.MAC)
+	case "meta-data/public-keys", "meta-data/public-keys/":
+		var keys []string
+		for i := range instance.PublicKeys {
+			keys = append(keys, fmt.Sprintf("%d=key-%d", i, i))
+		}
+		fmt.Fprint(w, strings.Join(keys, "\n"))
+	default:
+		var index int
+		var format string
+		if n, _ := fmt.Sscanf(path, "meta-data/public-keys/%d/%s", &index, &format); n >= 1 && index >= 0 && index < len(instance.PublicKeys) {
+			switch strings.TrimSuffix(format, "/") {
+			case "":
+				fmt.Fprint(w, "openssh-key")
+				return
+			case "openssh-key":
+				fmt.Fprint(w, instance.PublicKeys[index])
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}
+}
+
+func serveOpenStack(w http.ResponseWriter, r *http.Request, path string, instance types.MetadataInstance) {
+	switch path {
+	case "":
+		fmt.Fprint(w, "latest")
+	case "latest", "latest/":
+		fmt.Fprint(w, "meta_data.json\nuser_data")
+	case "latest/user_data":
+		serveUserData(w, r, instance)
+	case "latest/meta_data.json":
+		keys := make(map[string]string)
+		for i, key := range instance.PublicKeys {
+			keys[fmt.Sprintf("key-%d", i)] = key
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"uuid":        instance.InstanceID,
+			"hostname":    instance.Hostname,
+			"name":        instance.Hostname,
+			"public_keys": keys,
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveUserData(w http.ResponseWriter, r *http.Request, instance types.MetadataInstance) {
+	if instance.UserData == "" {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, instance.UserData)
+}
+
+func (s *Server) setInstance(instance types.MetadataInstance) error {
+	s.instancesLock.Lock()
+	defer s.instancesLock.Unlock()
+	if instance.MAC == "" {
+		s.defaultInstance = instance
+		return nil
+	}
+	if !s.portSecurity {
+		return errors.New("metadata of a single instance requires port security")
+	}
+	mac, err := net.ParseMAC(instance.MAC)
+	if err != nil {
+		return err
+	}
+	instance.MAC = mac.String()
+	s.instances[instance.MAC] = instance
+	return nil
+}
+
+func (s *Server) removeInstance(given string) error {
+	mac, err := net.ParseMAC(given)
+	if err != nil {
+		return err
+	}
+	s.instancesLock.Lock()
+	defer s.instancesLock.Unlock()
+	if _, ok := s.instances[mac.String()]; !ok {
+		return fmt.Errorf("no instance for %s", given)
+	}
+	delete(s.instances, mac.String())
+	return nil
+}
+
+func (s *Server) Mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/all", func(w http.ResponseWriter, r *http.Request) {
+		s.instancesLock.RLock()
+		instances := []types.MetadataInstance{s.defaultInstance}
+		for _, instance := range s.instances {
+			instances = append(instances, instance)
+		}
+		s.instancesLock.RUnlock()
+		_ = json.NewEncoder(w).Encode(instances)
+	})
+	mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "post only", http.StatusBadRequest)
+			return
+		}
+		var req types.MetadataInstance
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.setInstance(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/remove", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "post only", http.StatusBadRequest)
+			return
+		}
+		var req types.MetadataInstance
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.removeInstance(req.MAC); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
@@ -0,0 +1,125 @@
+package metadata
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	_, network, _ := net.ParseCIDR("127.0.0.0/8")
+	ipPool := tap.NewIPPool(network)
+	ipPool.Reserve(net.ParseIP("127.0.0.1"), "5a:94:ef:e4:0c:ee")
+
+	server := &Server{
+		ipPool:       ipPool,
+		portSecurity: true,
+		instances:    make(map[string]types.MetadataInstance),
+	}
+	httpServer := httptest.NewServer(server.handler())
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+func get(t *testing.T, url string) (int, string) {
+	res, err := http.Get(url)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	return res.StatusCode, string(body)
+}
+
+func TestEC2(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	assert.NoError(t, server.setInstance(types.MetadataInstance{
+		MAC:        "5A:94:EF:E4:0C:EE",
+		Hostname:   "fedora",
+		PublicKeys: []string{"ssh-ed25519 AAAA user@host"},
+		UserData:   "#cloud-config\n",
+	}))
+
+	status, body := get(t, httpServer.URL+"/latest/meta-data/instance-id")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "i-5a94efe40cee", body)
+
+	_, body = get(t, httpServer.URL+"/latest/meta-data/hostname")
+	assert.Equal(t, "fedora", body)
+
+	_, body = get(t, httpServer.URL+"/latest/meta-data/local-ipv4")
+	assert.Equal(t, "127.0.0.1", body)
+
+	_, body = get(t, httpServer.URL+"/latest/meta-data/public-keys/")
+	assert.Equal(t, "0=key-0", body)
+
+	_, body = get(t, httpServer.URL+"/latest/meta-data/public-keys/0/openssh-key")
+	assert.Equal(t, "ssh-ed25519 AAAA user@host", body)
+
+	status, _ = get(t, httpServer.URL+"/latest/meta-data/public-keys/1/openssh-key")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	_, body = get(t, httpServer.URL+"/latest/user-data")
+	assert.Equal(t, "#cloud-config\n", body)
+}
+
+func TestOpenStack(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	assert.NoError(t, server.setInstance(types.MetadataInstance{
+		PublicKeys: []string{"ssh-ed25519 AAAA user@host"},
+	}))
+
+	status, body := get(t, httpServer.URL+"/openstack/latest/meta_data.json")
+	assert.Equal(t, http.StatusOK, status)
+	var metadata map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(body), &metadata))
+	assert.Equal(t, "i-5a94efe40cee", metadata["uuid"])
+	assert.Equal(t, "127-0-0-1", metadata["hostname"])
+	assert.Equal(t, map[string]interface{}{"key-0": "ssh-ed25519 AAAA user@host"}, metadata["public_keys"])
+
+	status, _ = get(t, httpServer.URL+"/openstack/latest/user_data")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestInstancesRequirePortSecurity(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.portSecurity = false
+	assert.Error(t, server.setInstance(types.MetadataInstance{
+		MAC:      "5a:94:ef:e4:0c:ee",
+		UserData: "#cloud-config\n",
+	}))
+	assert.NoError(t, server.setInstance(types.MetadataInstance{
+		UserData: "#cloud-config\n",
+	}))
+
+	_, body := get(t, httpServer.URL+"/latest/user-data")
+	assert.Equal(t, "#cloud-config\n", body)
+}
+
+func TestEC2Versions(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	assert.NoError(t, server.setInstance(types.MetadataInstance{
+		MAC:      "5a:94:ef:e4:0c:ee",
+		UserData: "#cloud-config\n",
+	}))
+
+	// cloud-init asks for dated versions of the API
+	status, body := get(t, httpServer.URL+"/2009-04-04/meta-data/instance-id")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "i-5a94efe40cee", body)
+
+	_, body = get(t, httpServer.URL+"/2009-04-04/user-data")
+	assert.Equal(t, "#cloud-config\n", body)
+
+	status, _ = get(t, httpServer.URL+"/2009-04/meta-data/instance-id")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = get(t, httpServer.URL+"/v1/meta-data/instance-id")
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,220 @@
+package ndp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	// Default values from RFC 4861 section 6.2.1
+	advertisementInterval = 600 * time.Second
+	routerLifetime        = 3 * advertisementInterval
+	validLifetime         = 30 * 24 * time.Hour
+	preferredLifetime     = 7 * 24 * time.Hour
+
+	// RFC 8106 section 5.1 recommends a lifetime of at least 3 times the advertisement interval
+	dnsLifetime = 3 * advertisementInterval
+
+	// NDP messages must be sent with a hop limit of 255 (RFC 4861 section 6.1.2)
+	ndpHopLimit = 255
+
+	mtuOptionType = 5
+	mtuOptionSize = 8
+)
+
+// Server sends router advertisements on behalf of the gateway.
+// Guests use them to autoconfigure their IPv6 address (SLAAC) and their default route.
+type Server struct {
+	configuration *types.Configuration
+	endpoint      tcpip.Endpoint
+	waiterQueue   *waiter.Queue
+}
+
+func New(configuration *types.Configuration, s *stack.Stack) (*Server, error) {
+	var wq waiter.Queue
+	ep, err := s.NewRawEndpoint(header.ICMPv6ProtocolNumber, ipv6.ProtocolNumber, &wq, true)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	// Only router solicitations are interesting
+	var filter tcpip.ICMPv6Filter
+	for i := range filter.DenyType {
+		filter.DenyType[i] = ^uint32(0)
+	}
+	filter.DenyType[header.ICMPv6RouterSolicit/32] &^= 1 << (header.ICMPv6RouterSolicit % 32)
+	if err := ep.SetSockOpt(&filter); err != nil {
+		ep.Close()
+		return nil, errors.New(err.String())
+	}
+	if err := ep.SetSockOptInt(tcpip.MulticastTTLOption, ndpHopLimit); err != nil {
+		ep.Close()
+		return nil, errors.New(err.String())
+	}
+	if err := ep.SetSockOpt(&tcpip.AddMembershipOption{
+		NIC:           1,
+		MulticastAddr: header.IPv6AllRoutersLinkLocalMulticastAddress,
+	}); err != nil {
+		ep.Close()
+		return nil, errors.New(err.String())
+	}
+
+	return &Server{
+		configuration: configuration,
+		endpoint:      ep,
+		waiterQueue:   &wq,
+	}, nil
+}
+
+// Serve sends unsolicited router advertisements periodically and answers router solicitations.
+func (s *Server) Serve() error {
+	entry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+	s.waiterQueue.EventRegister(&entry)
+	defer s.waiterQueue.EventUnregister(&entry)
+
+	ticker := time.NewTicker(advertisementInterval)
+	defer ticker.Stop()
+
+	if err := s.advertise(); err != nil {
+		log.Errorf("ndp: cannot send router advertisement: %v", err)
+	}
+	for {
+		var buf bytes.Buffer
+		_, err := s.endpoint.Read(&buf, tcpip.ReadOptions{})
+		switch err.(type) {
+		case nil:
+			log.Debug("ndp: received router solicitation")
+			if err := s.advertise(); err != nil {
+				log.Errorf("ndp: cannot send router advertisement: %v", err)
+			}
+			continue
+		case *tcpip.ErrWouldBlock:
+		default:
+			return errors.New(err.String())
+		}
+
+		select {
+		case <-notifyCh:
+		case <-ticker.C:
+			if err := s.advertise(); err != nil {
+				log.Errorf("ndp: cannot send router advertisement: %v", err)
+			}
+		}
+	}
+}
+
+// advertise multicasts a router advertisement to all the nodes of the virtual network.
+func (s *Server) advertise() error {
+	ra, err := routerAdvertisement(s.configuration)
+	if err != nil {
+		return err
+	}
+
+	var r bytes.Reader
+	r.Reset(ra)
+	if _, err := s.endpoint.Write(&r, tcpip.WriteOptions{
+		To: &tcpip.FullAddress{
+			NIC:  1,
+			Addr: header.IPv6AllNodesMulticastAddress,
+		},
+	}); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
+
+// routerAdvertisement builds the ICMPv6 router advertisement message, the checksum is computed by the stack.
+func routerAdvertisement(configuration *types.Configuration) ([]byte, error) {
+	_, subnet, err := net.ParseCIDR(configuration.IPv6Subnet)
+	if err != nil {
+		return nil, err
+	}
+	prefixLength, _ := subnet.Mask.Size()
+	gatewayMac, err := net.ParseMAC(configuration.GatewayMacAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefix information option, RFC 4861 section 4.6.2
+	prefix := make([]byte, 30)
+	prefix[0] = uint8(prefixLength)
+	prefix[1] = 1 << 7 // on-link
+	if !configuration.DHCPv6Stateful && prefixLength == 64 {
+		prefix[1] |= 1 << 6 // autonomous address-configuration
+	}
+	binary.BigEndian.PutUint32(prefix[2:], uint32(validLifetime.Seconds()))
+	binary.BigEndian.PutUint32(prefix[6:], uint32(preferredLifetime.Seconds()))
+	copy(prefix[14:], subnet.IP.To16())
+
+	// Recursive DNS server option, RFC 8106 section 5.1
+	rdnss := make([]byte, 6+net.IPv6len)
+	binary.BigEndian.PutUint32(rdnss[2:], uint32(dnsLifetime.Seconds()))
+	copy(rdnss[6:], net.ParseIP(configuration.IPv6GatewayIP).To16())
+
+	options := header.NDPOptionsSerializer{
+		header.NDPSourceLinkLayerAddressOption(gatewayMac),
+		header.NDPPrefixInformation(prefix),
+		header.NDPRecursiveDNSServer(rdnss),
+	}
+	if searchList := dnsSearchList(configuration.DNSSearchDomains); searchList != nil {
+		options = append(options, searchList)
+	}
+
+	ra := make([]byte, header.ICMPv6HeaderSize+header.NDPRAMinimumSize+options.Length()+mtuOptionSize)
+	icmp := header.ICMPv6(ra)
+	icmp.SetType(header.ICMPv6RouterAdvert)
+
+	body := ra[header.ICMPv6HeaderSize:]
+	body[0] = ipv6.DefaultTTL // current hop limit
+	body[1] = 1 << 6          // other configuration (DNS) is available with DHCPv6
+	if configuration.DHCPv6Stateful {
+		body[1] |= 1 << 7 // managed address configuration
+	}
+	binary.BigEndian.PutUint16(body[2:], uint16(routerLifetime.Seconds()))
+
+	n := header.NDPOptions(body[header.NDPRAMinimumSize:]).Serialize(options)
+
+	// MTU option, RFC 4861 section 4.6.4
+	mtu := body[header.NDPRAMinimumSize+n:]
+	mtu[0] = mtuOptionType
+	mtu[1] = mtuOptionSize / 8
+	binary.BigEndian.PutUint32(mtu[4:], uint32(configuration.MTU))
+
+	return ra, nil
+}
+
+// dnsSearchList builds the DNS search list option, RFC 8106 section 5.2
+func dnsSearchList(domains []string) header.NDPDNSSearchList {
+	var names []byte
+	for _, domain := range domains {
+		for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+			if label == "" || len(label) > 63 {
+				continue
+			}
+			names = append(names, byte(len(label)))
+			names = append(names, label...)
+		}
+		names = append(names, 0)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	// Padding to a multiple of 8 bytes is added by the serializer
+	searchList := make([]byte, 6+len(names))
+	binary.BigEndian.PutUint32(searchList[2:], uint32(dnsLifetime.Seconds()))
+	copy(searchList[6:], names)
+	return searchList
+}
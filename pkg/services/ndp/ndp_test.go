@@ -0,0 +1,96 @@
+package ndp
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestRouterAdvertisement(t *testing.T) {
+	ra, err := routerAdvertisement(&types.Configuration{
+		MTU:               1500,
+		IPv6Subnet:        "fd00::/64",
+		IPv6GatewayIP:     "fd00::1",
+		GatewayMacAddress: "5a:94:ef:e4:0c:dd",
+		DNSSearchDomains:  []string{"containers.internal"},
+	})
+	assert.NoError(t, err)
+
+	icmp := header.ICMPv6(ra)
+	assert.Equal(t, header.ICMPv6RouterAdvert, icmp.Type())
+	advert := header.NDPRouterAdvert(icmp.MessageBody())
+	assert.False(t, advert.ManagedAddrConfFlag())
+	assert.True(t, advert.OtherConfFlag())
+	assert.Equal(t, routerLifetime, advert.RouterLifetime())
+
+	it, err := advert.Options().Iter(true)
+	assert.NoError(t, err)
+	var kinds []string
+	for {
+		opt, done, err := it.Next()
+		assert.NoError(t, err)
+		if done {
+			break
+		}
+		switch opt := opt.(type) {
+		case header.NDPSourceLinkLayerAddressOption:
+			kinds = append(kinds, "source")
+			assert.Equal(t, tcpip.LinkAddress("\x5a\x94\xef\xe4\x0c\xdd"), opt.EthernetAddress())
+		case header.NDPPrefixInformation:
+			kinds = append(kinds, "prefix")
+			assert.Equal(t, "fd00::/64", opt.Subnet().String())
+			assert.True(t, opt.OnLinkFlag())
+			assert.True(t, opt.AutonomousAddressConfigurationFlag())
+			assert.Equal(t, validLifetime, opt.ValidLifetime())
+			assert.Equal(t, preferredLifetime, opt.PreferredLifetime())
+		case header.NDPRecursiveDNSServer:
+			kinds = append(kinds, "rdnss")
+			addresses, err := opt.Addresses()
+			assert.NoError(t, err)
+			assert.Equal(t, []tcpip.Address{tcpip.AddrFrom16Slice([]byte{0xfd, 15: 1})}, addresses)
+			assert.Equal(t, dnsLifetime, opt.Lifetime())
+		case header.NDPDNSSearchList:
+			kinds = append(kinds, "dnssl")
+			domains, err := opt.DomainNames()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"containers.internal"}, domains)
+		}
+	}
+	assert.Equal(t, []string{"source", "prefix", "rdnss", "dnssl"}, kinds)
+
+	// the MTU option is the last one
+	mtu := ra[len(ra)-mtuOptionSize:]
+	assert.Equal(t, byte(mtuOptionType), mtu[0])
+	assert.Equal(t, uint32(1500), binary.BigEndian.Uint32(mtu[4:]))
+}
+
+func TestStatefulRouterAdvertisement(t *testing.T) {
+	ra, err := routerAdvertisement(&types.Configuration{
+		MTU:               1500,
+		IPv6Subnet:        "fd00::/64",
+		IPv6GatewayIP:     "fd00::1",
+		GatewayMacAddress: "5a:94:ef:e4:0c:dd",
+		DHCPv6Stateful:    true,
+	})
+	assert.NoError(t, err)
+
+	advert := header.NDPRouterAdvert(header.ICMPv6(ra).MessageBody())
+	assert.True(t, advert.ManagedAddrConfFlag())
+	it, err := advert.Options().Iter(true)
+	assert.NoError(t, err)
+	for {
+		opt, done, err := it.Next()
+		assert.NoError(t, err)
+		if done {
+			break
+		}
+		if prefix, ok := opt.(header.NDPPrefixInformation); ok {
+			// addresses are leased by DHCPv6, not autoconfigured
+			assert.False(t, prefix.AutonomousAddressConfigurationFlag())
+		}
+	}
+}
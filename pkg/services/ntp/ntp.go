@@ -0,0 +1,109 @@
+package ntp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	serverPort = 123
+	packetSize = 48
+
+	modeClient = 3
+	modeServer = 4
+
+	// The clock of the host is a local clock, not a reference clock, it is expected to be synchronized by the host
+	// itself. 10 is the usual stratum of local clocks, clients prefer any real server.
+	stratum = 10
+
+	// Seconds between the NTP era (1900) and the Unix epoch (1970)
+	ntpEpochOffset = 2208988800
+)
+
+var (
+	referenceID = []byte("LOCL")
+	// About a microsecond, as a power of two in seconds
+	precision int8 = -20
+)
+
+// Server is a SNTP server (RFC 4330) answering with the clock of the host.
+type Server struct {
+	conn net.PacketConn
+	now  func() time.Time
+}
+
+func New(configuration *types.Configuration, s *stack.Stack) (*Server, error) {
+	conn, err := gonet.DialUDP(s, &tcpip.FullAddress{
+		NIC:  1,
+		Addr: tcpip.AddrFrom4Slice(net.ParseIP(configuration.GatewayIP).To4()),
+		Port: serverPort,
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		conn: conn,
+		now:  time.Now,
+	}, nil
+}
+
+func (s *Server) Serve() error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		received := s.now()
+		reply := s.reply(buf[:n], received)
+		if reply == nil {
+			continue
+		}
+		if _, err := s.conn.WriteTo(reply, addr); err != nil {
+			log.Errorf("ntp: cannot reply to %s: %v", addr, err)
+		}
+	}
+}
+
+// reply returns the response to a client request, or nil if the packet is not a valid request.
+func (s *Server) reply(req []byte, received time.Time) []byte {
+	if len(req) < packetSize {
+		return nil
+	}
+	version := (req[0] >> 3) & 0x07
+	mode := req[0] & 0x07
+	if mode != modeClient || version < 1 || version > 4 {
+		return nil
+	}
+
+	res := make([]byte, packetSize)
+	// no leap second warning, same version as the client
+	res[0] = version<<3 | modeServer
+	res[1] = stratum
+	// poll interval of the client
+	res[2] = req[2]
+	res[3] = byte(precision)
+	// root delay and root dispersion are zero, the reference clock is local
+	copy(res[12:16], referenceID)
+	putTimestamp(res[16:24], received)
+	// origin timestamp is the transmit timestamp of the client
+	copy(res[24:32], req[40:48])
+	putTimestamp(res[32:40], received)
+	putTimestamp(res[40:48], s.now())
+	return res
+}
+
+func putTimestamp(b []byte, t time.Time) {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	binary.BigEndian.PutUint32(b, uint32(seconds))
+	binary.BigEndian.PutUint32(b[4:], uint32(fraction))
+}
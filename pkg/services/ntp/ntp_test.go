@@ -0,0 +1,60 @@
+package ntp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReply(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	now := time.Date(2024, 2, 29, 12, 0, 0, 500000000, time.UTC)
+	server := &Server{
+		conn: conn,
+		now:  func() time.Time { return now },
+	}
+	go func() {
+		_ = server.Serve()
+	}()
+	defer conn.Close()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	req := make([]byte, packetSize)
+	// version 4, client mode
+	req[0] = 4<<3 | modeClient
+	req[2] = 6
+	copy(req[40:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	_, err = client.Write(req)
+	assert.NoError(t, err)
+
+	assert.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	res := make([]byte, 1500)
+	n, err := client.Read(res)
+	assert.NoError(t, err)
+	assert.Equal(t, packetSize, n)
+	assert.Equal(t, byte(4<<3|modeServer), res[0])
+	assert.Equal(t, byte(stratum), res[1])
+	assert.Equal(t, byte(6), res[2])
+	assert.Equal(t, []byte("LOCL"), res[12:16])
+	assert.Equal(t, req[40:48], res[24:32])
+	assert.Equal(t, uint32(now.Unix()+ntpEpochOffset), binary.BigEndian.Uint32(res[40:]))
+	assert.Equal(t, uint32(1<<31), binary.BigEndian.Uint32(res[44:]))
+}
+
+func TestInvalidRequest(t *testing.T) {
+	server := &Server{now: time.Now}
+
+	assert.Nil(t, server.reply(make([]byte, 12), time.Now()))
+
+	req := make([]byte, packetSize)
+	// version 4, server mode
+	req[0] = 4<<3 | modeServer
+	assert.Nil(t, server.reply(req, time.Now()))
+}
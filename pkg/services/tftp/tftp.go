@@ -0,0 +1,298 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	serverPort = 69
+
+	opRRQ   = 1
+	opWRQ   = 2
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	opOACK  = 6
+
+	errNotDefined       = 0
+	errFileNotFound     = 1
+	errAccessViolation  = 2
+	errIllegalOperation = 4
+
+	defaultBlockSize = 512
+	minBlockSize     = 8
+	maxBlockSize     = 65464
+	defaultTimeout   = 3 * time.Second
+	retries          = 5
+)
+
+// Server is a read-only TFTP server (RFC 1350) with the blksize, timeout and tsize options (RFC 2347, 2348, 2349).
+// Files are served from a directory of the host. Each transfer uses its own port, as mandated by the protocol.
+type Server struct {
+	root     string
+	listener net.PacketConn
+	// opens a connection from a new port of the server to the client
+	dial func(remote net.Addr) (net.Conn, error)
+	// largest block size fitting in a packet
+	maxBlockSize int
+}
+
+func New(configuration *types.Configuration, s *stack.Stack) (*Server, error) {
+	gateway := tcpip.AddrFrom4Slice(net.ParseIP(configuration.GatewayIP).To4())
+	ln, err := gonet.DialUDP(s, &tcpip.FullAddress{
+		NIC:  1,
+		Addr: gateway,
+		Port: serverPort,
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	dial := func(remote net.Addr) (net.Conn, error) {
+		udpAddr, ok := remote.(*net.UDPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unexpected address type %T", remote)
+		}
+		return gonet.DialUDP(s, &tcpip.FullAddress{
+			NIC:  1,
+			Addr: gateway,
+		}, &tcpip.FullAddress{
+			NIC:  1,
+			Addr: tcpip.AddrFrom4Slice(udpAddr.IP.To4()),
+			Port: uint16(udpAddr.Port),
+		}, ipv4.ProtocolNumber)
+	}
+
+	return &Server{
+		root:     configuration.TFTPRoot,
+		listener: ln,
+		dial:     dial,
+		// IPv4 and UDP headers, then the opcode and block number
+		maxBlockSize: configuration.MTU - 20 - 8 - 4,
+	}, nil
+}
+
+func (s *Server) Serve() error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.listener.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		req := make([]byte, n)
+		copy(req, buf[:n])
+		go s.handle(addr, req)
+	}
+}
+
+func (s *Server) handle(remote net.Addr, req []byte) {
+	conn, err := s.dial(remote)
+	if err != nil {
+		log.Errorf("tftp: cannot open connection to %s: %v", remote, err)
+		return
+	}
+	defer conn.Close()
+
+	if len(req) < 2 {
+		return
+	}
+	switch binary.BigEndian.Uint16(req) {
+	case opRRQ:
+	case opWRQ:
+		sendError(conn, errAccessViolation, "read-only server")
+		return
+	default:
+		sendError(conn, errIllegalOperation, "illegal operation")
+		return
+	}
+
+	fields := bytes.Split(req[2:], []byte{0})
+	if len(fields) < 2 {
+		sendError(conn, errNotDefined, "malformed request")
+		return
+	}
+	filename := string(fields[0])
+	options := make(map[string]string)
+	for i := 2; i+1 < len(fields); i += 2 {
+		options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+
+	file, err := s.open(filename)
+	if err != nil {
+		log.Debugf("tftp: cannot open %s: %v", filename, err)
+		sendError(conn, errFileNotFound, "file not found")
+		return
+	}
+	defer file.Close()
+
+	log.Debugf("tftp: sending %s to %s", filename, remote)
+	if err := s.transfer(conn, file, options); err != nil {
+		log.Debugf("tftp: transfer of %s to %s failed: %v", filename, remote, err)
+	}
+}
+
+// open returns the file of the request, which can't be outside of the root directory.
+func (s *Server) open(filename string) (*os.File, error) {
+	clean := path.Clean("/" + strings.ReplaceAll(filename, "\\", "/"))
+	// symlinks inside the root may point anywhere, their target must be checked too
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(clean)))
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, os.ErrNotExist
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, errors.New("not a regular file")
+	}
+	return file, nil
+}
+
+func (s *Server) transfer(conn net.Conn, file *os.File, options map[string]string) error {
+	blockSize := defaultBlockSize
+	timeout := defaultTimeout
+
+	// Option negotiation, unknown options are ignored
+	var oack []byte
+	if value, ok := options["blksize"]; ok {
+		if size, err := strconv.Atoi(value); err == nil && size >= minBlockSize {
+			blockSize = size
+			if blockSize > maxBlockSize {
+				blockSize = maxBlockSize
+			}
+			if s.maxBlockSize > 0 && blockSize > s.maxBlockSize {
+				blockSize = s.maxBlockSize
+			}
+			oack = appendOption(oack, "blksize", strconv.Itoa(blockSize))
+		}
+	}
+	if value, ok := options["timeout"]; ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 1 && seconds <= 255 {
+			timeout = time.Duration(seconds) * time.Second
+			oack = appendOption(oack, "timeout", value)
+		}
+	}
+	if _, ok := options["tsize"]; ok {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		oack = appendOption(oack, "tsize", strconv.FormatInt(info.Size(), 10))
+	}
+	if len(oack) > 0 {
+		pkt := append([]byte{0, opOACK}, oack...)
+		if err := sendAndWait(conn, pkt, 0, timeout); err != nil {
+			return err
+		}
+	}
+
+	data := make([]byte, blockSize)
+	pkt := make([]byte, 4+blockSize)
+	// Block numbers wrap around for files larger than 65535 blocks, like most clients expect
+	var block uint16 = 1
+	for ; ; block++ {
+		n, err := io.ReadFull(file, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			sendError(conn, errNotDefined, "read error")
+			return err
+		}
+		binary.BigEndian.PutUint16(pkt, opDATA)
+		binary.BigEndian.PutUint16(pkt[2:], block)
+		copy(pkt[4:], data[:n])
+		if err := sendAndWait(conn, pkt[:4+n], block, timeout); err != nil {
+			return err
+		}
+		// The last block is shorter than the block size, possibly empty
+		if n < blockSize {
+			return nil
+		}
+	}
+}
+
+// sendAndWait sends the packet until the client acknowledges the block.
+func sendAndWait(conn net.Conn, pkt []byte, block uint16, timeout time.Duration) error {
+	buf := make([]byte, 512)
+	for attempt := 0; attempt < retries; attempt++ {
+		if _, err := conn.Write(pkt); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(timeout)
+		for {
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				return err
+			}
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+			if n < 4 {
+				continue
+			}
+			switch binary.BigEndian.Uint16(buf) {
+			case opACK:
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+				// duplicate acknowledgment of a previous block, keep waiting
+			case opERROR:
+				return fmt.Errorf("client error: %s", strings.TrimRight(string(buf[4:n]), "\x00"))
+			default:
+				sendError(conn, errIllegalOperation, "illegal operation")
+				return errors.New("unexpected packet from client")
+			}
+		}
+	}
+	return errors.New("timeout")
+}
+
+func appendOption(pkt []byte, name string, value string) []byte {
+	pkt = append(pkt, name...)
+	pkt = append(pkt, 0)
+	pkt = append(pkt, value...)
+	return append(pkt, 0)
+}
+
+func sendError(conn net.Conn, code uint16, message string) {
+	pkt := make([]byte, 4, 5+len(message))
+	binary.BigEndian.PutUint16(pkt, opERROR)
+	binary.BigEndian.PutUint16(pkt[2:], code)
+	pkt = append(pkt, message...)
+	pkt = append(pkt, 0)
+	_, _ = conn.Write(pkt)
+}
@@ -0,0 +1,114 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startServer(t *testing.T, root string) net.Addr {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	server := &Server{
+		root:     root,
+		listener: ln,
+		dial: func(remote net.Addr) (net.Conn, error) {
+			return net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, remote.(*net.UDPAddr))
+		},
+	}
+	go func() {
+		_ = server.Serve()
+	}()
+	return ln.LocalAddr()
+}
+
+func request(filename string, options ...string) []byte {
+	pkt := []byte{0, opRRQ}
+	pkt = appendOption(pkt, filename, "octet")
+	for i := 0; i+1 < len(options); i += 2 {
+		pkt = appendOption(pkt, options[i], options[i+1])
+	}
+	return pkt
+}
+
+func ack(block uint16) []byte {
+	pkt := make([]byte, 4)
+	binary.BigEndian.PutUint16(pkt, opACK)
+	binary.BigEndian.PutUint16(pkt[2:], block)
+	return pkt
+}
+
+func TestTransfer(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("pxelinux"), 300)
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "boot.ipxe"), content, 0600))
+	addr := startServer(t, root)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = client.WriteTo(request("/boot.ipxe", "blksize", "1024", "tsize", "0"), addr)
+	assert.NoError(t, err)
+
+	buf := make([]byte, 2048)
+	n, peer, err := client.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, append([]byte{0, opOACK}, appendOption(appendOption(nil, "blksize", "1024"), "tsize", "2400")...), buf[:n])
+	// the transfer happens on another port of the server
+	assert.NotEqual(t, addr.String(), peer.String())
+	_, err = client.WriteTo(ack(0), peer)
+	assert.NoError(t, err)
+
+	var received []byte
+	for block := uint16(1); ; block++ {
+		n, _, err := client.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(opDATA), binary.BigEndian.Uint16(buf))
+		assert.Equal(t, block, binary.BigEndian.Uint16(buf[2:]))
+		received = append(received, buf[4:n]...)
+		_, err = client.WriteTo(ack(block), peer)
+		assert.NoError(t, err)
+		if n-4 < 1024 {
+			break
+		}
+	}
+	assert.Equal(t, content, received)
+}
+
+func TestOutsideOfRoot(t *testing.T) {
+	parent := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0600))
+	root := filepath.Join(parent, "tftp")
+	assert.NoError(t, os.Mkdir(root, 0700))
+	filenames := []string{"../secret"}
+	if err := os.Symlink(filepath.Join(parent, "secret"), filepath.Join(root, "link")); err == nil {
+		filenames = append(filenames, "link")
+	}
+	addr := startServer(t, root)
+
+	for _, filename := range filenames {
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer client.Close()
+		assert.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+
+		_, err = client.WriteTo(request(filename), addr)
+		assert.NoError(t, err)
+
+		buf := make([]byte, 512)
+		n, _, err := client.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(opERROR), binary.BigEndian.Uint16(buf[:n]), filename)
+		assert.Equal(t, uint16(errFileNotFound), binary.BigEndian.Uint16(buf[2:n]), filename)
+	}
+}
@@ -0,0 +1,74 @@
+package tap
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// DefaultDatagramBatchSize is the number of frames moved with one system call on the datagram sockets when not configured.
+const DefaultDatagramBatchSize = 32
+
+// batchConn moves several datagrams with one system call. It is only available on Linux (recvmmsg and sendmmsg).
+type batchConn interface {
+	// readBatch receives up to len(bufs) datagrams and sets their sizes, -1 for the ones truncated.
+	readBatch(bufs [][]byte, sizes []int) (int, error)
+	// writeBatch sends one datagram per packet, made of its slices.
+	writeBatch(pkts [][][]byte) error
+}
+
+// maxFrameSize is the size of the largest frame sent by the virtual machines, with a VLAN tag.
+func (e *Switch) maxFrameSize() int {
+	if e.maxTransmissionUnit <= 0 {
+		return 1024 * 128
+	}
+	return e.maxTransmissionUnit + header.EthernetMinimumSize + 4
+}
+
+func (e *Switch) rxBatch(ctx context.Context, id int, conn batchConn, batchSize int) error {
+	frameSize := e.maxFrameSize()
+	views := make([]*buffer.View, batchSize)
+	bufs := make([][]byte, len(views))
+	sizes := make([]int, len(views))
+	defer func() {
+		for _, view := range views {
+			if view != nil {
+				view.Release()
+			}
+		}
+	}()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		default:
+			// passthrough
+		}
+		// frames are received in pooled views, given to the packets without copy
+		for i := range views {
+			if views[i] == nil {
+				views[i] = buffer.NewViewSize(frameSize)
+				bufs[i] = views[i].AsSlice()
+			}
+		}
+		n, err := conn.readBatch(bufs, sizes)
+		if err != nil {
+			return errors.Wrap(err, "cannot read packets from socket")
+		}
+		for i := 0; i < n; i++ {
+			if sizes[i] < 0 {
+				log.Warnf("dropping a frame larger than %d bytes", frameSize)
+				continue
+			}
+			view := views[i]
+			views[i] = nil
+			view.CapLength(sizes[i])
+			e.rxView(ctx, id, view)
+		}
+	}
+	return nil
+}
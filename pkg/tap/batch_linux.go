@@ -0,0 +1,158 @@
+package tap
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is the struct mmsghdr of recvmmsg(2) and sendmmsg(2), padded like in C.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// linuxBatchConn uses recvmmsg and sendmmsg on a unixgram or unixpacket socket.
+type linuxBatchConn struct {
+	rawConn syscall.RawConn
+	// an empty message is the end of the connection
+	seqpacket bool
+
+	rxHeaders []mmsghdr
+	rxIovecs  []unix.Iovec
+	txHeaders []mmsghdr
+	txIovecs  []unix.Iovec
+}
+
+// newBatchConn returns a batchConn for the datagram sockets, or false for the other connections.
+func newBatchConn(conn net.Conn) (batchConn, bool) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, false
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	var sockType int
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockType, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE)
+	}); err != nil || sockErr != nil {
+		return nil, false
+	}
+	if sockType != unix.SOCK_DGRAM && sockType != unix.SOCK_SEQPACKET {
+		return nil, false
+	}
+	return &linuxBatchConn{
+		rawConn:   rawConn,
+		seqpacket: sockType == unix.SOCK_SEQPACKET,
+	}, true
+}
+
+func (c *linuxBatchConn) readBatch(bufs [][]byte, sizes []int) (int, error) {
+	if len(c.rxHeaders) < len(bufs) {
+		c.rxHeaders = make([]mmsghdr, len(bufs))
+		c.rxIovecs = make([]unix.Iovec, len(bufs))
+	}
+	for i, buf := range bufs {
+		c.rxIovecs[i].Base = &buf[0]
+		c.rxIovecs[i].SetLen(len(buf))
+		c.rxHeaders[i] = mmsghdr{}
+		c.rxHeaders[i].hdr.Iov = &c.rxIovecs[i]
+		c.rxHeaders[i].hdr.SetIovlen(1)
+	}
+
+	var n int
+	var errno syscall.Errno
+	if err := c.rawConn.Read(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&c.rxHeaders[0])), uintptr(len(bufs)), unix.MSG_DONTWAIT, 0, 0)
+		if e == unix.EAGAIN || e == unix.EINTR {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	for i := 0; i < n; i++ {
+		if c.seqpacket && c.rxHeaders[i].len == 0 {
+			// the following calls return the end of the connection
+			if i == 0 {
+				return 0, io.EOF
+			}
+			return i, nil
+		}
+		sizes[i] = int(c.rxHeaders[i].len)
+		if c.rxHeaders[i].hdr.Flags&unix.MSG_TRUNC != 0 {
+			// the frame doesn't fit in the buffer, it is dropped
+			sizes[i] = -1
+		}
+	}
+	return n, nil
+}
+
+func (c *linuxBatchConn) writeBatch(pkts [][][]byte) error {
+	iovecs := 0
+	for _, slices := range pkts {
+		iovecs += len(slices)
+	}
+	if len(c.txHeaders) < len(pkts) {
+		c.txHeaders = make([]mmsghdr, len(pkts))
+	}
+	if len(c.txIovecs) < iovecs {
+		c.txIovecs = make([]unix.Iovec, iovecs)
+	}
+	iovec := 0
+	for i, slices := range pkts {
+		c.txHeaders[i] = mmsghdr{}
+		first := iovec
+		for _, slice := range slices {
+			if len(slice) == 0 {
+				continue
+			}
+			c.txIovecs[iovec].Base = &slice[0]
+			c.txIovecs[iovec].SetLen(len(slice))
+			iovec++
+		}
+		if iovec > first {
+			c.txHeaders[i].hdr.Iov = &c.txIovecs[first]
+			c.txHeaders[i].hdr.SetIovlen(iovec - first)
+		}
+	}
+
+	sent := 0
+	var errno syscall.Errno
+	if err := c.rawConn.Write(func(fd uintptr) bool {
+		for sent < len(pkts) {
+			r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&c.txHeaders[sent])), uintptr(len(pkts)-sent), unix.MSG_DONTWAIT, 0, 0)
+			if e == unix.EAGAIN {
+				return false
+			}
+			if e == unix.EINTR {
+				continue
+			}
+			if e != 0 {
+				errno = e
+				return true
+			}
+			sent += int(r)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
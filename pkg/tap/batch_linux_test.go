@@ -0,0 +1,95 @@
+package tap
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type fakeGateway struct{}
+
+func (g *fakeGateway) DeliverNetworkPacket(tcpip.NetworkProtocolNumber, stack.PacketBufferPtr) {}
+
+func (g *fakeGateway) LinkAddress() tcpip.LinkAddress {
+	return "\x5a\x94\xef\xe4\x0c\x01"
+}
+
+func (g *fakeGateway) IP() string {
+	return "192.168.127.1"
+}
+
+func seqpacketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	assert.NoError(t, err)
+	var conns []*net.UnixConn
+	for _, fd := range fds {
+		file := os.NewFile(uintptr(fd), "seqpacket")
+		conn, err := net.FileConn(file)
+		assert.NoError(t, err)
+		file.Close()
+		conns = append(conns, conn.(*net.UnixConn))
+	}
+	return conns[0], conns[1]
+}
+
+func TestBatchConn(t *testing.T) {
+	local, peer := seqpacketPair(t)
+	defer local.Close()
+	defer peer.Close()
+
+	batch, ok := newBatchConn(local)
+	assert.True(t, ok)
+	_, ok = newBatchConn(&net.TCPConn{})
+	assert.False(t, ok)
+
+	assert.NoError(t, batch.writeBatch([][][]byte{{[]byte("he"), []byte("llo")}, {[]byte("world")}, {[]byte("large frame")}}))
+
+	bufs := [][]byte{make([]byte, 8), make([]byte, 8), make([]byte, 8), make([]byte, 8)}
+	sizes := make([]int, len(bufs))
+	peerBatch, _ := newBatchConn(peer)
+	n, err := peerBatch.readBatch(bufs, sizes)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "hello", string(bufs[0][:sizes[0]]))
+	assert.Equal(t, "world", string(bufs[1][:sizes[1]]))
+	assert.Equal(t, -1, sizes[2])
+}
+
+func TestSwitchBatches(t *testing.T) {
+	sw := NewSwitch(false, 1500)
+	sw.Connect(&fakeGateway{})
+
+	sender, senderPeer := seqpacketPair(t)
+	receiver, receiverPeer := seqpacketPair(t)
+	defer receiverPeer.Close()
+	go func() { _ = sw.Accept(context.Background(), sender, types.BessProtocol) }()
+	go func() { _ = sw.Accept(context.Background(), receiver, types.BessProtocol) }()
+	assert.Eventually(t, func() bool { return len(sw.Drops()) == 2 }, time.Second, 10*time.Millisecond)
+
+	for i := byte(0); i < 100; i++ {
+		frame := broadcastFrame(i)
+		_, err := senderPeer.Write(frame.ToView().AsSlice())
+		frame.DecRef()
+		assert.NoError(t, err)
+	}
+	buf := make([]byte, 1500)
+	assert.NoError(t, receiverPeer.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for i := byte(0); i < 100; i++ {
+		n, err := receiverPeer.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 15, n)
+		assert.Equal(t, i, buf[n-1])
+	}
+
+	// the end of the connection disconnects the port
+	assert.NoError(t, senderPeer.Close())
+	assert.Eventually(t, func() bool { return len(sw.Drops()) == 1 }, time.Second, 10*time.Millisecond)
+}
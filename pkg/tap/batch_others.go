@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package tap
+
+import (
+	"net"
+)
+
+// newBatchConn returns false, datagrams are moved one by one outside of Linux.
+func newBatchConn(_ net.Conn) (batchConn, bool) {
+	return nil, false
+}
@@ -0,0 +1,150 @@
+package tap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// DefaultCAMAgingTime is the time after which the switch forgets the addresses it doesn't see anymore, like most
+// switches.
+const DefaultCAMAgingTime = 5 * time.Minute
+
+type camEntry struct {
+	port     int
+	lastSeen time.Time
+}
+
+// SetCAM changes how long the addresses are remembered by the switch without frames coming from them, and how many
+// addresses are learnt on each port, without limit when 0.
+func (e *Switch) SetCAM(agingTime time.Duration, maxAddresses int) error {
+	if agingTime < 0 {
+		return fmt.Errorf("invalid aging time %s", agingTime)
+	}
+	if agingTime == 0 {
+		agingTime = DefaultCAMAgingTime
+	}
+	if maxAddresses < 0 {
+		return fmt.Errorf("invalid maximum number of addresses %d", maxAddresses)
+	}
+	e.camLock.Lock()
+	defer e.camLock.Unlock()
+	e.camAgingTime = agingTime
+	e.camMaxAddresses = maxAddresses
+	return nil
+}
+
+func (e *Switch) CAM() map[string]int {
+	now := e.now()
+	e.camLock.RLock()
+	defer e.camLock.RUnlock()
+	ret := make(map[string]int)
+	for address, entry := range e.cam {
+		if e.alive(entry, now) {
+			ret[address.String()] = entry.port
+		}
+	}
+	return ret
+}
+
+// CAMEntries returns the addresses learnt by the switch, with their port and the time since their last frame.
+func (e *Switch) CAMEntries() map[string]types.CAMEntry {
+	now := e.now()
+	remotes := make(map[int]string)
+	e.connLock.Lock()
+	for id, port := range e.conns {
+		remotes[id] = port.conn.RemoteAddr().String()
+	}
+	e.connLock.Unlock()
+
+	e.camLock.RLock()
+	defer e.camLock.RUnlock()
+	ret := make(map[string]types.CAMEntry)
+	for address, entry := range e.cam {
+		if !e.alive(entry, now) {
+			continue
+		}
+		ret[address.String()] = types.CAMEntry{
+			Port:   entry.port,
+			Remote: remotes[entry.port],
+			Age:    int(now.Sub(entry.lastSeen).Seconds()),
+		}
+	}
+	return ret
+}
+
+// flooding returns whether frames for unknown addresses are sent to all the ports. They are dropped with port
+// security, the other virtual machines must not see them.
+func (e *Switch) flooding() bool {
+	e.camLock.RLock()
+	defer e.camLock.RUnlock()
+	return e.security == nil
+}
+
+// alive returns whether the entry is not older than the aging time. The CAM lock must be held.
+func (e *Switch) alive(entry camEntry, now time.Time) bool {
+	return now.Sub(entry.lastSeen) <= e.camAgingTime
+}
+
+// learn records that frames for the address must be sent to the port.
+// It returns false when the port has already the maximum number of addresses, the frames of the new address must be
+// dropped.
+func (e *Switch) learn(address tcpip.LinkAddress, id int) bool {
+	now := e.now()
+	e.camLock.Lock()
+	defer e.camLock.Unlock()
+
+	if entry, ok := e.cam[address]; ok && entry.port == id {
+		e.cam[address] = camEntry{port: id, lastSeen: now}
+		return true
+	}
+
+	// new address, or moved from another port
+	e.expire(now)
+	if e.camMaxAddresses > 0 && e.addresses(id) >= e.camMaxAddresses {
+		log.Debugf("port %d has already %d addresses, dropping the frames of %s", id, e.camMaxAddresses, address)
+		return false
+	}
+	e.cam[address] = camEntry{port: id, lastSeen: now}
+	return true
+}
+
+// lookup returns the port of the address, or false when the address is unknown or too old.
+// With port security, addresses are bound to their port until it is disconnected.
+func (e *Switch) lookup(address tcpip.LinkAddress) (int, bool) {
+	now := e.now()
+	e.camLock.RLock()
+	defer e.camLock.RUnlock()
+	if e.security != nil {
+		id, ok := e.bindings[address]
+		return id, ok
+	}
+	entry, ok := e.cam[address]
+	if !ok || !e.alive(entry, now) {
+		return 0, false
+	}
+	return entry.port, true
+}
+
+// expire removes the entries older than the aging time. The CAM lock must be held.
+func (e *Switch) expire(now time.Time) {
+	for address, entry := range e.cam {
+		if !e.alive(entry, now) {
+			delete(e.cam, address)
+		}
+	}
+}
+
+// addresses returns the number of addresses learnt on the port. The CAM lock must be held.
+func (e *Switch) addresses(id int) int {
+	count := 0
+	for _, entry := range e.cam {
+		if entry.port == id {
+			count++
+		}
+	}
+	return count
+}
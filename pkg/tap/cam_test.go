@@ -0,0 +1,106 @@
+package tap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	mac1 = tcpip.LinkAddress("\x5a\x94\xef\xe4\x0c\xee")
+	mac2 = tcpip.LinkAddress("\x5a\x94\xef\xe4\x0c\xef")
+	mac3 = tcpip.LinkAddress("\x5a\x94\xef\xe4\x0c\xf0")
+)
+
+func unicastFrame(dst, src tcpip.LinkAddress) stack.PacketBufferPtr {
+	frame := make([]byte, header.EthernetMinimumSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{SrcAddr: src, DstAddr: dst, Type: header.IPv4ProtocolNumber})
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(frame),
+	})
+}
+
+func TestCAMAging(t *testing.T) {
+	sw := NewSwitch(false, 1500)
+	assert.NoError(t, sw.SetCAM(time.Minute, 0))
+	now := time.Now()
+	sw.now = func() time.Time { return now }
+
+	sw.learn(mac1, 0)
+	sw.learn(mac2, 1)
+	assert.Equal(t, map[string]int{mac1.String(): 0, mac2.String(): 1}, sw.CAM())
+
+	now = now.Add(30 * time.Second)
+	sw.learn(mac2, 1)
+	assert.Equal(t, types.CAMEntry{Port: 1}, sw.CAMEntries()[mac2.String()])
+	assert.Equal(t, types.CAMEntry{Port: 0, Age: 30}, sw.CAMEntries()[mac1.String()])
+
+	now = now.Add(45 * time.Second)
+	_, ok := sw.lookup(mac1)
+	assert.False(t, ok)
+	port, ok := sw.lookup(mac2)
+	assert.True(t, ok)
+	assert.Equal(t, 1, port)
+
+	// the address moved to another port
+	sw.learn(mac2, 2)
+	port, _ = sw.lookup(mac2)
+	assert.Equal(t, 2, port)
+	// expired entries are removed when learning new addresses
+	assert.Len(t, sw.cam, 1)
+}
+
+func TestCAMMaxAddresses(t *testing.T) {
+	sw := NewSwitch(false, 1500)
+	assert.NoError(t, sw.SetCAM(0, 2))
+	assert.Error(t, sw.SetCAM(0, -1))
+
+	assert.True(t, sw.learn(mac1, 0))
+	assert.True(t, sw.learn(mac2, 0))
+	assert.False(t, sw.learn(mac3, 0))
+	_, ok := sw.lookup(mac3)
+	assert.False(t, ok)
+	assert.True(t, sw.learn(mac3, 1))
+	_, ok = sw.lookup(mac3)
+	assert.True(t, ok)
+}
+
+func TestUnknownUnicastFlooding(t *testing.T) {
+	sw := NewSwitch(false, 1500)
+	for id := 0; id < 3; id++ {
+		sw.conns[id] = newPort(protocolConn{}, 10, types.TailDrop)
+	}
+	sw.learn(mac1, 0)
+
+	// known destination
+	pkt := unicastFrame(mac1, mac2)
+	assert.NoError(t, sw.txPkt(1, pkt))
+	pkt.DecRef()
+	assert.Equal(t, []int{1, 0, 0}, queued(sw))
+
+	// unknown destination, flooded except to the source port
+	pkt = unicastFrame(mac3, mac2)
+	assert.NoError(t, sw.txPkt(1, pkt))
+	pkt.DecRef()
+	assert.Equal(t, []int{2, 0, 1}, queued(sw))
+
+	// destination on the source port, filtered
+	pkt = unicastFrame(mac1, mac2)
+	assert.NoError(t, sw.txPkt(0, pkt))
+	pkt.DecRef()
+	assert.Equal(t, []int{2, 0, 1}, queued(sw))
+}
+
+func queued(sw *Switch) []int {
+	var ret []int
+	for id := 0; id < len(sw.conns); id++ {
+		ret = append(ret, len(sw.conns[id].queue))
+	}
+	return ret
+}
@@ -2,9 +2,120 @@ package tap
 
 import (
 	"net"
+	"sync/atomic"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
 type protocolConn struct {
 	net.Conn
 	protocolImpl protocol
+	// nil when datagrams are moved one by one
+	batch     batchConn
+	batchSize int
+}
+
+// port is a connection of the switch with its transmit queue, emptied by its own goroutine.
+type port struct {
+	conn       protocolConn
+	queue      chan stack.PacketBufferPtr
+	dropPolicy types.TxDropPolicy
+	dropped    uint64
+	// frames received against the port security
+	violations uint64
+
+	// reused by the writer of the port
+	size    []byte
+	vectors net.Buffers
+	scratch []byte
+	pending []stack.PacketBufferPtr
+	slices  [][][]byte
+}
+
+func newPort(conn protocolConn, queueLength int, dropPolicy types.TxDropPolicy) *port {
+	return &port{
+		conn:       conn,
+		queue:      make(chan stack.PacketBufferPtr, queueLength),
+		dropPolicy: dropPolicy,
+	}
+}
+
+// enqueue adds a reference of the packet to the queue, or drops a packet according to the policy when it is full.
+// Packets are enqueued with the connection lock of the switch held, so that the queue can't be closed meanwhile.
+func (p *port) enqueue(pkt stack.PacketBufferPtr) {
+	pkt.IncRef()
+	for {
+		select {
+		case p.queue <- pkt:
+			return
+		default:
+		}
+		if p.dropPolicy != types.HeadDrop {
+			atomic.AddUint64(&p.dropped, 1)
+			pkt.DecRef()
+			return
+		}
+		select {
+		case oldest := <-p.queue:
+			atomic.AddUint64(&p.dropped, 1)
+			oldest.DecRef()
+		default:
+			// the queue has been emptied by the writer meanwhile
+		}
+	}
+}
+
+// write sends the packet on the connection. Stream protocols use a single vectored write for the size and the packet.
+func (p *port) write(pkt stack.PacketBufferPtr) error {
+	slices := pkt.AsSlices()
+	if p.conn.protocolImpl.Stream() {
+		sProtocol := p.conn.protocolImpl.(streamProtocol)
+		if p.size == nil {
+			p.size = sProtocol.Buf()
+		}
+		sProtocol.Write(p.size, pkt.Size())
+
+		// WriteTo consumes the vectors, they are rebuilt from the start of the same array each time
+		p.vectors = append(append(p.vectors[:0], p.size), slices...)
+		vectors := p.vectors
+		_, err := vectors.WriteTo(p.conn.Conn)
+		return err
+	}
+
+	// datagram protocols need the packet in one write
+	buf := slices[0]
+	if len(slices) > 1 {
+		p.scratch = p.scratch[:0]
+		for _, slice := range slices {
+			p.scratch = append(p.scratch, slice...)
+		}
+		buf = p.scratch
+	}
+	_, err := p.conn.Write(buf)
+	return err
+}
+
+// writePackets sends the packets, with one system call when the connection supports batches.
+func (p *port) writePackets(pkts []stack.PacketBufferPtr) error {
+	if p.conn.batch == nil || len(pkts) == 1 {
+		for _, pkt := range pkts {
+			if err := p.write(pkt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	p.slices = p.slices[:0]
+	for _, pkt := range pkts {
+		p.slices = append(p.slices, pkt.AsSlices())
+	}
+	return p.conn.batch.writeBatch(p.slices)
+}
+
+// drain releases the packets still queued after the port is disconnected.
+func (p *port) drain() {
+	for pkt := range p.queue {
+		pkt.DecRef()
+	}
 }
@@ -1,53 +1,188 @@
 package tap
 
 import (
+	"encoding/json"
 	"errors"
+	"math"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/apparentlymart/go-cidr/cidr"
+	log "github.com/sirupsen/logrus"
 )
 
+// DefaultLeaseTime is the lifetime of dynamic leases, they must be renewed before it expires.
+const DefaultLeaseTime = time.Hour
+
+type lease struct {
+	mac string
+	// zero for static leases, they never expire
+	expiry time.Time
+	// name sent by the client, if any
+	hostname string
+	// MAC address of the client, when mac is another identifier like a DHCPv6 DUID
+	linkAddress string
+}
+
+// A declined address is kept as a lease without owner until it expires
+const declined = ""
+
+// ErrNotLeased is returned by Request when the client asks for an address that it can't lease.
+var ErrNotLeased = errors.New("requested address is not leased to the client")
+
 type IPPool struct {
-	base   *net.IPNet
-	count  uint64
-	leases map[string]string
-	lock   sync.Mutex
+	base      *net.IPNet
+	count     uint64
+	leaseTime time.Duration
+	leases    map[string]lease
+	database  string
+	lock      sync.Mutex
+
+	now func() time.Time
 }
 
 func NewIPPool(base *net.IPNet) *IPPool {
+	count := cidr.AddressCount(base)
+	if count == 0 {
+		// more than 2^64 addresses, e.g. an IPv6 /64
+		count = math.MaxUint64
+	}
 	return &IPPool{
-		base:   base,
-		count:  cidr.AddressCount(base),
-		leases: make(map[string]string),
+		base:      base,
+		count:     count,
+		leaseTime: DefaultLeaseTime,
+		leases:    make(map[string]lease),
+		now:       time.Now,
 	}
 }
 
+// LeaseTime is the lifetime of dynamic leases to advertise to the clients.
+func (p *IPPool) LeaseTime() time.Duration {
+	return p.leaseTime
+}
+
+// Leases returns the active leases, indexed by IP.
 func (p *IPPool) Leases() map[string]string {
 	p.lock.Lock()
 	defer p.lock.Unlock()
+	p.purge()
 	leases := map[string]string{}
 	for key, value := range p.leases {
-		leases[key] = value
+		if value.mac == declined {
+			continue
+		}
+		leases[key] = value.mac
 	}
 	return leases
 }
 
+// LinkAddress returns the MAC address recorded with SetLinkAddress for the active lease of ip.
+func (p *IPPool) LinkAddress(ip net.IP) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.purge()
+	existing, ok := p.leases[ip.String()]
+	if !ok || existing.linkAddress == "" {
+		return "", false
+	}
+	return existing.linkAddress, true
+}
+
+// SetLinkAddress records the MAC address of the client owning the lease of mac, which may be another identifier.
+func (p *IPPool) SetLinkAddress(mac string, linkAddress string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.purge()
+
+	for ip, candidate := range p.leases {
+		if candidate.mac == mac && candidate.linkAddress != linkAddress {
+			candidate.linkAddress = linkAddress
+			p.leases[ip] = candidate
+			p.save()
+		}
+	}
+}
+
+// Owner returns the MAC address having an active lease of ip.
+func (p *IPPool) Owner(ip net.IP) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.purge()
+	existing, ok := p.leases[ip.String()]
+	if !ok || existing.mac == declined {
+		return "", false
+	}
+	return existing.mac, true
+}
+
 func (p *IPPool) Mask() int {
 	ones, _ := p.base.Mask.Size()
 	return ones
 }
 
+// Lookup returns the IP leased to mac, without renewing it.
+func (p *IPPool) Lookup(mac string) (net.IP, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.purge()
+	for ip, candidate := range p.leases {
+		if candidate.mac == mac {
+			return net.ParseIP(ip), true
+		}
+	}
+	return nil, false
+}
+
+// GetOrAssign returns the IP leased to mac, or leases a new one.
+// Dynamic leases are renewed for the lease time on each call.
 func (p *IPPool) GetOrAssign(mac string) (net.IP, error) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
+	return p.getOrAssign(mac, nil)
+}
+
+// Request is like GetOrAssign, but when requested is set, it leases this address to a client without lease if it is
+// available. It fails with ErrNotLeased without leasing anything if the client has another address, or if the requested
+// one is used or is not an address of the pool.
+func (p *IPPool) Request(mac string, requested net.IP) (net.IP, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.getOrAssign(mac, requested)
+}
+
+// getOrAssign implements GetOrAssign and Request. The lock must be held.
+func (p *IPPool) getOrAssign(mac string, requested net.IP) (net.IP, error) {
+	p.purge()
+	mismatch := func(ip net.IP) bool {
+		return requested != nil && !requested.IsUnspecified() && !requested.Equal(ip)
+	}
 
 	for ip, candidate := range p.leases {
-		if candidate == mac {
+		if candidate.mac == mac {
+			if mismatch(net.ParseIP(ip)) {
+				return nil, ErrNotLeased
+			}
+			if !candidate.expiry.IsZero() {
+				candidate.expiry = p.now().Add(p.leaseTime)
+				p.leases[ip] = candidate
+				p.save()
+			}
 			return net.ParseIP(ip), nil
 		}
 	}
 
+	if requested != nil && !requested.IsUnspecified() {
+		// the requested address is granted if it is available (RFC 2131 section 4.3.2)
+		if _, ok := p.leases[requested.String()]; ok || !p.assignable(requested) {
+			return nil, ErrNotLeased
+		}
+		p.leases[requested.String()] = lease{mac: mac, expiry: p.now().Add(p.leaseTime)}
+		p.save()
+		return requested, nil
+	}
+
 	var i uint64
 	for i = 1; i < p.count; i++ {
 		candidate, err := cidr.Host(p.base, int(i))
@@ -55,32 +190,204 @@ func (p *IPPool) GetOrAssign(mac string) (net.IP, error) {
 			continue
 		}
 		if _, ok := p.leases[candidate.String()]; !ok {
-			p.leases[candidate.String()] = mac
+			p.leases[candidate.String()] = lease{mac: mac, expiry: p.now().Add(p.leaseTime)}
+			p.save()
 			return candidate, nil
 		}
 	}
 	return nil, errors.New("cannot find available IP")
 }
 
+// assignable returns whether ip is one of the addresses given by the pool, not the network or broadcast address.
+func (p *IPPool) assignable(ip net.IP) bool {
+	if !p.base.Contains(ip) {
+		return false
+	}
+	first, last := cidr.AddressRange(p.base)
+	return !ip.Equal(first) && (ip.To4() == nil || !ip.Equal(last))
+}
+
+// Hostnames returns the addresses of the active leases having a hostname, indexed by hostname.
+func (p *IPPool) Hostnames() map[string]string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.purge()
+	hostnames := map[string]string{}
+	for ip, value := range p.leases {
+		if value.hostname == "" {
+			continue
+		}
+		hostnames[value.hostname] = ip
+	}
+	return hostnames
+}
+
+// SetHostname records the hostname of the client owning the lease of mac.
+// A hostname belongs to a single lease, the last client using it wins.
+func (p *IPPool) SetHostname(mac string, hostname string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.purge()
+
+	changed := false
+	for ip, candidate := range p.leases {
+		switch {
+		case candidate.mac == mac && candidate.hostname != hostname:
+			candidate.hostname = hostname
+		case candidate.mac != mac && hostname != "" && candidate.hostname == hostname:
+			candidate.hostname = ""
+		default:
+			continue
+		}
+		p.leases[ip] = candidate
+		changed = true
+	}
+	if changed {
+		p.save()
+	}
+}
+
+// Reserve adds a static lease, it never expires and can't be released.
 func (p *IPPool) Reserve(ip net.IP, mac string) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	p.leases[ip.String()] = mac
+	p.leases[ip.String()] = lease{mac: mac, linkAddress: mac}
 }
 
+// Release frees the dynamic lease of the given MAC address.
 func (p *IPPool) Release(given string) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	var found string
-	for ip, mac := range p.leases {
-		if mac == given {
-			found = ip
-			break
+	for ip, candidate := range p.leases {
+		if candidate.mac == given && !candidate.expiry.IsZero() {
+			delete(p.leases, ip)
+			p.save()
+			return
+		}
+	}
+}
+
+// ReleaseAddress frees the dynamic lease of ip, only if it belongs to the given MAC address.
+func (p *IPPool) ReleaseAddress(given string, ip net.IP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	existing, ok := p.leases[ip.String()]
+	if !ok || existing.mac != given || existing.expiry.IsZero() {
+		return
+	}
+	delete(p.leases, ip.String())
+	p.save()
+}
+
+// Decline marks the IP leased to the given MAC address as used by an unknown host on the network.
+// It is not leased again before the lease time is elapsed. Other addresses are ignored.
+func (p *IPPool) Decline(given string, ip net.IP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.purge()
+	existing, ok := p.leases[ip.String()]
+	if !ok || existing.mac != given || existing.expiry.IsZero() {
+		return
+	}
+	p.leases[ip.String()] = lease{mac: declined, expiry: p.now().Add(p.leaseTime)}
+	p.save()
+}
+
+func (p *IPPool) expired(l lease) bool {
+	return !l.expiry.IsZero() && !p.now().Before(l.expiry)
+}
+
+// purge deletes the expired leases. The lock must be held.
+func (p *IPPool) purge() {
+	for ip, value := range p.leases {
+		if p.expired(value) {
+			delete(p.leases, ip)
+		}
+	}
+}
+
+type databaseEntry struct {
+	IP          string    `json:"ip"`
+	MAC         string    `json:"mac"`
+	Expiry      time.Time `json:"expiry"`
+	Hostname    string    `json:"hostname,omitempty"`
+	LinkAddress string    `json:"linkAddress,omitempty"`
+}
+
+// UseDatabase loads the dynamic leases saved in path, and saves them there on each change.
+// A missing file is not an error, it is created with the first lease.
+// Static leases must be reserved before, they take precedence over the saved ones.
+func (p *IPPool) UseDatabase(path string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var entries []databaseEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
 		}
+		known := make(map[string]bool)
+		for _, existing := range p.leases {
+			known[existing.mac] = true
+		}
+		for _, entry := range entries {
+			ip := net.ParseIP(entry.IP)
+			if ip == nil || !p.base.Contains(ip) || entry.MAC == "" || entry.Expiry.IsZero() {
+				continue
+			}
+			candidate := lease{mac: entry.MAC, expiry: entry.Expiry, hostname: entry.Hostname, linkAddress: entry.LinkAddress}
+			if _, ok := p.leases[ip.String()]; ok || known[entry.MAC] || p.expired(candidate) {
+				continue
+			}
+			p.leases[ip.String()] = candidate
+			known[entry.MAC] = true
+		}
+	}
+
+	p.database = path
+	return nil
+}
+
+// save writes the dynamic leases in the database, if any. The lock must be held.
+func (p *IPPool) save() {
+	if p.database == "" {
+		return
+	}
+
+	entries := []databaseEntry{}
+	for ip, value := range p.leases {
+		if value.mac == declined || value.expiry.IsZero() || p.expired(value) {
+			continue
+		}
+		entries = append(entries, databaseEntry{
+			IP:          ip,
+			MAC:         value.mac,
+			Expiry:      value.expiry,
+			Hostname:    value.hostname,
+			LinkAddress: value.linkAddress,
+		})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		log.Errorf("cannot encode leases: %v", err)
+		return
+	}
+
+	// Write and rename to never leave a truncated file behind
+	tmp := p.database + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Errorf("cannot save leases: %v", err)
+		return
 	}
-	if found != "" {
-		delete(p.leases, found)
+	if err := os.Rename(tmp, p.database); err != nil {
+		log.Errorf("cannot save leases: %v", err)
 	}
 }
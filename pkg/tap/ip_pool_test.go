@@ -2,7 +2,9 @@ package tap
 
 import (
 	"net"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,7 +27,12 @@ func TestIPPool(t *testing.T) {
 
 	assert.Equal(t, map[string]string{"10.0.0.1": "mac1", "10.0.0.2": "mac2"}, pool.Leases())
 
-	pool.Release("mac1")
+	// only the owner can release its address
+	pool.ReleaseAddress("mac2", ip1)
+	pool.ReleaseAddress("mac1", ip2)
+	assert.Equal(t, map[string]string{"10.0.0.1": "mac1", "10.0.0.2": "mac2"}, pool.Leases())
+
+	pool.ReleaseAddress("mac1", ip1)
 
 	assert.Equal(t, map[string]string{"10.0.0.2": "mac2"}, pool.Leases())
 
@@ -39,3 +46,179 @@ func TestIPPool(t *testing.T) {
 
 	assert.Equal(t, map[string]string{"10.0.0.1": "mac3", "10.0.0.2": "mac2", "10.0.0.3": "mac4"}, pool.Leases())
 }
+
+func TestIPv6Pool(t *testing.T) {
+	_, network, _ := net.ParseCIDR("fd00::/64")
+	pool := NewIPPool(network)
+	pool.Reserve(net.ParseIP("fd00::1"), "gateway")
+
+	ip1, err := pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00::2", ip1.String())
+
+	assert.Equal(t, map[string]string{"fd00::1": "gateway", "fd00::2": "mac1"}, pool.Leases())
+}
+
+func TestIPPoolExpiry(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	pool := NewIPPool(network)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	pool.Reserve(net.ParseIP("10.0.0.1"), "gateway")
+
+	ip1, err := pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", ip1.String())
+
+	// renewed before expiry
+	now = now.Add(DefaultLeaseTime / 2)
+	_, err = pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	now = now.Add(DefaultLeaseTime * 3 / 4)
+	assert.Equal(t, map[string]string{"10.0.0.1": "gateway", "10.0.0.2": "mac1"}, pool.Leases())
+
+	now = now.Add(DefaultLeaseTime)
+	assert.Equal(t, map[string]string{"10.0.0.1": "gateway"}, pool.Leases())
+
+	// the address of an expired lease is given back to its owner
+	ip1, err = pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", ip1.String())
+
+	// or to someone else
+	now = now.Add(2 * DefaultLeaseTime)
+	ip2, err := pool.GetOrAssign("mac2")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", ip2.String())
+
+	// static leases are never released
+	pool.Release("gateway")
+	assert.Equal(t, map[string]string{"10.0.0.1": "gateway", "10.0.0.2": "mac2"}, pool.Leases())
+}
+
+func TestIPPoolDecline(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	pool := NewIPPool(network)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	ip1, err := pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", ip1.String())
+
+	// only the owner of the lease can decline it
+	pool.Decline("mac2", ip1)
+	assert.Equal(t, map[string]string{"10.0.0.1": "mac1"}, pool.Leases())
+
+	pool.Decline("mac1", ip1)
+	assert.Equal(t, map[string]string{}, pool.Leases())
+
+	ip1, err = pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", ip1.String())
+
+	now = now.Add(DefaultLeaseTime)
+	ip2, err := pool.GetOrAssign("mac2")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", ip2.String())
+}
+
+func TestIPPoolDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+
+	pool := NewIPPool(network)
+	pool.Reserve(net.ParseIP("10.0.0.1"), "gateway")
+	assert.NoError(t, pool.UseDatabase(path))
+	_, err := pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	_, err = pool.GetOrAssign("mac2")
+	assert.NoError(t, err)
+	pool.Release("mac1")
+
+	restarted := NewIPPool(network)
+	restarted.Reserve(net.ParseIP("10.0.0.1"), "gateway")
+	assert.NoError(t, restarted.UseDatabase(path))
+	assert.Equal(t, map[string]string{"10.0.0.1": "gateway", "10.0.0.3": "mac2"}, restarted.Leases())
+
+	ip2, err := restarted.GetOrAssign("mac2")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.3", ip2.String())
+}
+
+func TestIPPoolHostnames(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	pool := NewIPPool(network)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	_, err := pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	_, err = pool.GetOrAssign("mac2")
+	assert.NoError(t, err)
+	pool.SetHostname("mac1", "fedora")
+	assert.Equal(t, map[string]string{"fedora": "10.0.0.1"}, pool.Hostnames())
+
+	// renewals keep the hostname
+	now = now.Add(DefaultLeaseTime / 2)
+	_, err = pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"fedora": "10.0.0.1"}, pool.Hostnames())
+
+	// the last client wins
+	pool.SetHostname("mac2", "fedora")
+	assert.Equal(t, map[string]string{"fedora": "10.0.0.2"}, pool.Hostnames())
+
+	pool.Release("mac2")
+	assert.Equal(t, map[string]string{}, pool.Hostnames())
+
+	pool.SetHostname("mac1", "ubuntu")
+	now = now.Add(DefaultLeaseTime)
+	assert.Equal(t, map[string]string{}, pool.Hostnames())
+}
+
+func TestIPPoolRequest(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	pool := NewIPPool(network)
+	pool.Reserve(net.ParseIP("10.0.0.1"), "gateway")
+
+	// an available address is granted
+	ip1, err := pool.Request("mac1", net.ParseIP("10.0.0.5"))
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.5", ip1.String())
+
+	// but not another one to a client having a lease
+	_, err = pool.Request("mac1", net.ParseIP("10.0.0.6"))
+	assert.ErrorIs(t, err, ErrNotLeased)
+
+	ip1, err = pool.Request("mac1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.5", ip1.String())
+
+	// addresses used or outside of the pool are refused without lease
+	for _, requested := range []string{"10.0.0.1", "10.0.0.5", "10.0.0.0", "10.0.0.255", "10.0.1.1"} {
+		_, err = pool.Request("mac2", net.ParseIP(requested))
+		assert.ErrorIs(t, err, ErrNotLeased, requested)
+	}
+	assert.Equal(t, map[string]string{"10.0.0.1": "gateway", "10.0.0.5": "mac1"}, pool.Leases())
+
+	ip2, err := pool.Request("mac2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", ip2.String())
+}
+
+func TestIPPoolPurge(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	pool := NewIPPool(network)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	ip1, err := pool.GetOrAssign("mac1")
+	assert.NoError(t, err)
+	pool.SetHostname("mac1", "fedora")
+
+	now = now.Add(DefaultLeaseTime)
+	_, ok := pool.Owner(ip1)
+	assert.False(t, ok)
+	assert.Empty(t, pool.leases)
+}
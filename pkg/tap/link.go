@@ -2,6 +2,7 @@ package tap
 
 import (
 	"net"
+	"sync"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -17,6 +18,8 @@ type LinkEndpoint struct {
 	mac        tcpip.LinkAddress
 	ip         string
 	virtualIPs map[string]struct{}
+	// protects virtualIPs, they can be changed at runtime
+	virtualIPsLock sync.RWMutex
 
 	dispatcher    stack.NetworkDispatcher
 	networkSwitch NetworkSwitch
@@ -109,11 +112,10 @@ func (e *LinkEndpoint) writePacket(r stack.RouteInfo, protocol tcpip.NetworkProt
 	})
 
 	h := header.ARP(pkt.NetworkHeader().Slice())
-	if h.IsValid() &&
+	if protocol == header.ARPProtocolNumber && h.IsValid() &&
 		h.Op() == header.ARPReply {
 		ip := tcpip.AddrFromSlice(h.ProtocolAddressSender()).String()
-		_, ok := e.virtualIPs[ip]
-		if ip != e.IP() && !ok {
+		if ip != e.IP() && !e.IsVirtualIP(ip) {
 			log.Debugf("dropping spoofing packets from the gateway about IP %s", ip)
 			return nil
 		}
@@ -135,3 +137,23 @@ func (e *LinkEndpoint) WriteRawPacket(_ stack.PacketBufferPtr) tcpip.Error {
 func (e *LinkEndpoint) IP() string {
 	return e.ip
 }
+
+// AddVirtualIP allows the gateway to answer ARP requests about ip.
+func (e *LinkEndpoint) AddVirtualIP(ip string) {
+	e.virtualIPsLock.Lock()
+	defer e.virtualIPsLock.Unlock()
+	e.virtualIPs[ip] = struct{}{}
+}
+
+func (e *LinkEndpoint) RemoveVirtualIP(ip string) {
+	e.virtualIPsLock.Lock()
+	defer e.virtualIPsLock.Unlock()
+	delete(e.virtualIPs, ip)
+}
+
+func (e *LinkEndpoint) IsVirtualIP(ip string) bool {
+	e.virtualIPsLock.RLock()
+	defer e.virtualIPsLock.RUnlock()
+	_, ok := e.virtualIPs[ip]
+	return ok
+}
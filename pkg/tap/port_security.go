@@ -0,0 +1,259 @@
+package tap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// DefaultPortSecurityMaxAddresses is the number of MAC addresses a port can use with port security, when the
+// number of addresses of the CAM is not limited.
+const DefaultPortSecurityMaxAddresses = 16
+
+// ipv6AddressesPerMAC is the number of IPv6 addresses bound to a MAC address, the oldest one is released after.
+const ipv6AddressesPerMAC = 16
+
+// EnablePortSecurity binds each port to the MAC addresses it uses first, and these addresses to the IPs leased to
+// them by the pools, with DHCP or static leases. The frames of the ports using the address of another port or of the
+// gateway are dropped, and frames are only sent to the port bound to their destination, never flooded.
+// IPv6 addresses not leased by DHCPv6 are allowed, they can be configured with SLAAC. They are bound to the first MAC
+// address using them, like the leased ones to the MAC address of their DHCPv6 client.
+func (e *Switch) EnablePortSecurity(ipPool *IPPool, ipv6Pool *IPPool) error {
+	if ipPool == nil {
+		return errors.New("port security needs an IP pool")
+	}
+	e.camLock.Lock()
+	defer e.camLock.Unlock()
+	e.security = &portSecurity{
+		ipPool:    ipPool,
+		ipv6Pool:  ipv6Pool,
+		ipv6:      make(map[string]tcpip.LinkAddress),
+		ipv6Order: make(map[tcpip.LinkAddress][]string),
+	}
+	return nil
+}
+
+type portSecurity struct {
+	ipPool   *IPPool
+	ipv6Pool *IPPool
+
+	// MAC address of each IPv6 address, and the addresses of each MAC address from the oldest
+	ipv6Lock  sync.Mutex
+	ipv6      map[string]tcpip.LinkAddress
+	ipv6Order map[tcpip.LinkAddress][]string
+}
+
+// IPv6LinkAddress returns the MAC address bound to an IPv6 address by the port security.
+func (e *Switch) IPv6LinkAddress(ip net.IP) (tcpip.LinkAddress, bool) {
+	e.camLock.RLock()
+	security := e.security
+	e.camLock.RUnlock()
+	if security == nil {
+		return "", false
+	}
+	security.ipv6Lock.Lock()
+	defer security.ipv6Lock.Unlock()
+	mac, ok := security.ipv6[ip.String()]
+	return mac, ok
+}
+
+// Violations returns the number of frames dropped because of the port security, indexed by port.
+func (e *Switch) Violations() map[int]uint64 {
+	e.connLock.Lock()
+	defer e.connLock.Unlock()
+	ret := make(map[int]uint64)
+	for id, port := range e.conns {
+		ret[id] = atomic.LoadUint64(&port.violations)
+	}
+	return ret
+}
+
+// secure returns whether the frame received on the port can be switched, and counts it otherwise.
+// It is always true when port security is disabled.
+func (e *Switch) secure(id int, eth header.Ethernet) bool {
+	e.camLock.RLock()
+	security := e.security
+	e.camLock.RUnlock()
+	if security == nil {
+		return true
+	}
+	if err := e.checkFrame(id, eth, security); err != nil {
+		log.Debugf("port %d: %v", id, err)
+		e.connLock.Lock()
+		if port, ok := e.conns[id]; ok {
+			atomic.AddUint64(&port.violations, 1)
+		}
+		e.connLock.Unlock()
+		return false
+	}
+	return true
+}
+
+// checkFrame binds the source address of a valid frame to the port.
+func (e *Switch) checkFrame(id int, eth header.Ethernet, security *portSecurity) error {
+	src := eth.SourceAddress()
+	if header.IsMulticastEthernetAddress(src) || src == e.gateway.LinkAddress() {
+		return fmt.Errorf("invalid source address %s", src)
+	}
+	if err := security.checkPayload(src, e.gateway.LinkAddress(), eth.Type(), eth[header.EthernetMinimumSize:]); err != nil {
+		return err
+	}
+	return e.bind(src, id)
+}
+
+// checkPayload validates the addresses used by mac in ARP and IP packets. Other protocols are refused.
+func (s *portSecurity) checkPayload(mac tcpip.LinkAddress, gateway tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, payload []byte) error {
+	switch protocol {
+	case header.ARPProtocolNumber:
+		arp := header.ARP(payload)
+		if !arp.IsValid() {
+			return errors.New("invalid ARP packet")
+		}
+		if sender := tcpip.LinkAddress(arp.HardwareAddressSender()); sender != mac {
+			return fmt.Errorf("ARP sender %s doesn't match source address %s", sender, mac)
+		}
+		return s.checkIPv4(mac, net.IP(arp.ProtocolAddressSender()))
+	case header.IPv4ProtocolNumber:
+		if len(payload) < header.IPv4MinimumSize {
+			return errors.New("invalid IPv4 packet")
+		}
+		src := header.IPv4(payload).SourceAddress().As4()
+		return s.checkIPv4(mac, net.IP(src[:]))
+	case header.IPv6ProtocolNumber:
+		if len(payload) < header.IPv6MinimumSize {
+			return errors.New("invalid IPv6 packet")
+		}
+		ip := header.IPv6(payload)
+		src := ip.SourceAddress().As16()
+		if err := s.checkIPv6(mac, gateway, net.IP(src[:])); err != nil {
+			return err
+		}
+		// the target of neighbor advertisements is the address announced
+		if ip.NextHeader() == uint8(header.ICMPv6ProtocolNumber) && len(payload) >= header.IPv6MinimumSize+header.ICMPv6NeighborAdvertMinimumSize {
+			icmp := header.ICMPv6(payload[header.IPv6MinimumSize:])
+			if icmp.Type() == header.ICMPv6NeighborAdvert {
+				target := header.NDPNeighborAdvert(icmp.MessageBody()).TargetAddress().As16()
+				return s.checkIPv6(mac, gateway, net.IP(target[:]))
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported protocol %#04x from %s", protocol, mac)
+	}
+}
+
+// checkIPv4 allows only the unspecified address, used by DHCP and ARP probes, and the address leased to mac.
+func (s *portSecurity) checkIPv4(mac tcpip.LinkAddress, ip net.IP) error {
+	if ip.IsUnspecified() {
+		return nil
+	}
+	owner, ok := s.ipPool.Owner(ip)
+	if !ok {
+		return fmt.Errorf("%s uses %s without lease", mac, ip)
+	}
+	if owner != mac.String() {
+		return fmt.Errorf("%s uses %s leased to %s", mac, ip, owner)
+	}
+	return nil
+}
+
+// checkIPv6 refuses the addresses of the gateway, the ones leased to another MAC address, or already used by another
+// one. The unspecified address is allowed for duplicate address detection.
+func (s *portSecurity) checkIPv6(mac tcpip.LinkAddress, gateway tcpip.LinkAddress, ip net.IP) error {
+	if ip.IsUnspecified() {
+		return nil
+	}
+	if linkLocal := header.LinkLocalAddr(gateway).As16(); ip.Equal(linkLocal[:]) {
+		return fmt.Errorf("%s uses %s of the gateway", mac, ip)
+	}
+	leased := false
+	if s.ipv6Pool != nil {
+		if owner, ok := s.ipv6Pool.LinkAddress(ip); ok {
+			if owner != mac.String() {
+				return fmt.Errorf("%s uses %s leased to %s", mac, ip, owner)
+			}
+			leased = true
+		}
+	}
+
+	s.ipv6Lock.Lock()
+	defer s.ipv6Lock.Unlock()
+	if bound, ok := s.ipv6[ip.String()]; ok {
+		if bound == mac {
+			return nil
+		}
+		if !leased {
+			return fmt.Errorf("%s uses %s of %s", mac, ip, bound)
+		}
+		// the lease wins over an address taken before
+		s.unbindIPv6(bound, ip.String())
+	}
+	s.ipv6[ip.String()] = mac
+	s.ipv6Order[mac] = append(s.ipv6Order[mac], ip.String())
+	if addresses := s.ipv6Order[mac]; len(addresses) > ipv6AddressesPerMAC {
+		s.unbindIPv6(mac, addresses[0])
+	}
+	return nil
+}
+
+// unbindIPv6 releases an IPv6 address bound to mac. The IPv6 lock must be held.
+func (s *portSecurity) unbindIPv6(mac tcpip.LinkAddress, ip string) {
+	delete(s.ipv6, ip)
+	addresses := s.ipv6Order[mac]
+	for i, address := range addresses {
+		if address == ip {
+			addresses = append(addresses[:i:i], addresses[i+1:]...)
+			break
+		}
+	}
+	if len(addresses) == 0 {
+		delete(s.ipv6Order, mac)
+	} else {
+		s.ipv6Order[mac] = addresses
+	}
+}
+
+// release frees the IPv6 addresses of a MAC address when its port is disconnected.
+func (s *portSecurity) release(mac tcpip.LinkAddress) {
+	s.ipv6Lock.Lock()
+	defer s.ipv6Lock.Unlock()
+	for _, ip := range s.ipv6Order[mac] {
+		delete(s.ipv6, ip)
+	}
+	delete(s.ipv6Order, mac)
+}
+
+// bind reserves the address for the port until it is disconnected.
+// A port can't have more than the maximum number of addresses of the CAM, or DefaultPortSecurityMaxAddresses.
+func (e *Switch) bind(address tcpip.LinkAddress, id int) error {
+	e.camLock.Lock()
+	defer e.camLock.Unlock()
+
+	if owner, ok := e.bindings[address]; ok {
+		if owner != id {
+			return fmt.Errorf("%s is used by port %d", address, owner)
+		}
+		return nil
+	}
+	maxAddresses := e.camMaxAddresses
+	if maxAddresses == 0 {
+		maxAddresses = DefaultPortSecurityMaxAddresses
+	}
+	count := 0
+	for _, owner := range e.bindings {
+		if owner == id {
+			count++
+		}
+	}
+	if count >= maxAddresses {
+		return fmt.Errorf("port has already %d addresses, %s refused", count, address)
+	}
+	e.bindings[address] = id
+	return nil
+}
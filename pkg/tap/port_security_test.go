@@ -0,0 +1,234 @@
+package tap
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	gatewayMAC         = "5a:94:ef:e4:0c:01"
+	gatewayLinkAddress = tcpip.LinkAddress("\x5a\x94\xef\xe4\x0c\x01")
+)
+
+// gatewayDispatcher counts the frames delivered to the gateway.
+type gatewayDispatcher struct {
+	delivered int
+}
+
+func (d *gatewayDispatcher) DeliverNetworkPacket(tcpip.NetworkProtocolNumber, stack.PacketBufferPtr) {
+	d.delivered++
+}
+
+func (d *gatewayDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, stack.PacketBufferPtr) {}
+
+func secureSwitch(t *testing.T, ipPool *IPPool, ipv6Pool *IPPool, ports int) (*Switch, *gatewayDispatcher) {
+	gateway, err := NewLinkEndpoint(false, 1500, gatewayMAC, "192.168.127.1", nil)
+	assert.NoError(t, err)
+	dispatcher := &gatewayDispatcher{}
+	gateway.Attach(dispatcher)
+
+	sw := NewSwitch(false, 1500)
+	sw.Connect(gateway)
+	if ipPool != nil {
+		assert.NoError(t, sw.EnablePortSecurity(ipPool, ipv6Pool))
+	}
+	for id := 0; id < ports; id++ {
+		sw.conns[id] = newPort(protocolConn{}, 100, types.TailDrop)
+	}
+	return sw, dispatcher
+}
+
+func testPool(t *testing.T) *IPPool {
+	_, subnet, _ := net.ParseCIDR("192.168.127.0/24")
+	pool := NewIPPool(subnet)
+	pool.Reserve(net.ParseIP("192.168.127.1"), gatewayMAC)
+	pool.Reserve(net.ParseIP("192.168.127.3"), mac2.String())
+	ip, err := pool.GetOrAssign(mac1.String())
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.127.2", ip.String())
+	return pool
+}
+
+func ipv4Frame(src tcpip.LinkAddress, ip string) *buffer.View {
+	frame := make([]byte, header.EthernetMinimumSize+header.IPv4MinimumSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{SrcAddr: src, DstAddr: header.EthernetBroadcastAddress, Type: header.IPv4ProtocolNumber})
+	copy(frame[header.EthernetMinimumSize+12:], net.ParseIP(ip).To4())
+	return buffer.NewViewWithData(frame)
+}
+
+func gratuitousARP(src tcpip.LinkAddress, ip string) *buffer.View {
+	frame := make([]byte, header.EthernetMinimumSize+header.ARPSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{SrcAddr: src, DstAddr: header.EthernetBroadcastAddress, Type: header.ARPProtocolNumber})
+	arp := header.ARP(frame[header.EthernetMinimumSize:])
+	arp.SetIPv4OverEthernet()
+	arp.SetOp(header.ARPReply)
+	copy(arp.HardwareAddressSender(), src)
+	copy(arp.ProtocolAddressSender(), net.ParseIP(ip).To4())
+	copy(arp.ProtocolAddressTarget(), net.ParseIP(ip).To4())
+	return buffer.NewViewWithData(frame)
+}
+
+func neighborAdvertisement(src tcpip.LinkAddress, target string) *buffer.View {
+	frame := make([]byte, header.EthernetMinimumSize+header.IPv6MinimumSize+header.ICMPv6NeighborAdvertMinimumSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{SrcAddr: src, DstAddr: "\x33\x33\x00\x00\x00\x01", Type: header.IPv6ProtocolNumber})
+	header.IPv6(frame[header.EthernetMinimumSize:]).Encode(&header.IPv6Fields{
+		PayloadLength:     header.ICMPv6NeighborAdvertMinimumSize,
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          255,
+		SrcAddr:           tcpip.AddrFrom16Slice(net.ParseIP("fe80::5894:efff:fee4:cee")),
+		DstAddr:           header.IPv6AllNodesMulticastAddress,
+	})
+	icmp := header.ICMPv6(frame[header.EthernetMinimumSize+header.IPv6MinimumSize:])
+	icmp.SetType(header.ICMPv6NeighborAdvert)
+	header.NDPNeighborAdvert(icmp.MessageBody()).SetTargetAddress(tcpip.AddrFrom16Slice(net.ParseIP(target)))
+	return buffer.NewViewWithData(frame)
+}
+
+func TestPortSecurity(t *testing.T) {
+	sw, gateway := secureSwitch(t, testPool(t), nil, 3)
+	assert.Error(t, sw.EnablePortSecurity(nil, nil))
+	ctx := context.Background()
+
+	sw.rxView(ctx, 0, ipv4Frame(mac1, "192.168.127.2"))
+	// address leased to another virtual machine, or not leased
+	sw.rxView(ctx, 0, ipv4Frame(mac1, "192.168.127.3"))
+	sw.rxView(ctx, 0, ipv4Frame(mac1, "192.168.127.4"))
+	// MAC address used by another port, or by the gateway
+	sw.rxView(ctx, 1, ipv4Frame(mac1, "192.168.127.2"))
+	sw.rxView(ctx, 1, ipv4Frame(gatewayLinkAddress, "192.168.127.1"))
+	// gratuitous ARPs
+	sw.rxView(ctx, 1, gratuitousARP(mac2, "192.168.127.1"))
+	sw.rxView(ctx, 1, gratuitousARP(mac2, "192.168.127.3"))
+	// DHCP discover
+	sw.rxView(ctx, 2, ipv4Frame(mac3, "0.0.0.0"))
+
+	assert.Equal(t, map[int]uint64{0: 2, 1: 3, 2: 0}, sw.Violations())
+	assert.Equal(t, map[string]int{mac1.String(): 0, mac2.String(): 1, mac3.String(): 2}, sw.CAM())
+	// only the allowed frames are switched
+	assert.Equal(t, []int{2, 2, 2}, queued(sw))
+	assert.Equal(t, 3, gateway.delivered)
+}
+
+func TestPortSecurityBindsValidFramesOnly(t *testing.T) {
+	sw, _ := secureSwitch(t, testPool(t), nil, 2)
+	ctx := context.Background()
+
+	// a port spoofing the address of a virtual machine not connected yet doesn't get its MAC address
+	sw.rxView(ctx, 1, ipv4Frame(mac1, "192.168.127.2"))
+	sw.rxView(ctx, 1, ipv4Frame(mac1, "192.168.127.3"))
+	sw.rxView(ctx, 0, ipv4Frame(mac2, "192.168.127.3"))
+	assert.Equal(t, map[tcpip.LinkAddress]int{mac1: 1, mac2: 0}, sw.bindings)
+	assert.Equal(t, map[int]uint64{0: 0, 1: 1}, sw.Violations())
+
+	// the number of addresses of a port is limited without CAM limit
+	for i := 0; i < DefaultPortSecurityMaxAddresses+1; i++ {
+		sw.rxView(ctx, 0, ipv4Frame(tcpip.LinkAddress([]byte{0x5a, 0x94, 0xef, 0xe4, 0x0d, byte(i)}), "0.0.0.0"))
+	}
+	assert.Len(t, sw.bindings, DefaultPortSecurityMaxAddresses+1)
+	assert.Equal(t, map[int]uint64{0: 2, 1: 1}, sw.Violations())
+}
+
+func TestPortSecurityDoesNotFlood(t *testing.T) {
+	sw, _ := secureSwitch(t, testPool(t), nil, 3)
+	now := time.Now()
+	sw.now = func() time.Time { return now }
+	sw.rxView(context.Background(), 0, ipv4Frame(mac1, "192.168.127.2"))
+	assert.Equal(t, []int{0, 1, 1}, queued(sw))
+
+	// the CAM entry expired, the frame is still sent only to the port bound to the address
+	now = now.Add(2 * DefaultCAMAgingTime)
+	assert.Empty(t, sw.CAM())
+	pkt := unicastFrame(mac1, gatewayLinkAddress)
+	assert.NoError(t, sw.tx(pkt))
+	pkt.DecRef()
+	assert.Equal(t, []int{1, 1, 1}, queued(sw))
+
+	// unknown unicast is dropped
+	pkt = unicastFrame(mac3, gatewayLinkAddress)
+	assert.NoError(t, sw.tx(pkt))
+	pkt.DecRef()
+	assert.Equal(t, []int{1, 1, 1}, queued(sw))
+}
+
+func TestPortSecurityNeighborAdvertisement(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("fd00::/64")
+	ipv6Pool := NewIPPool(subnet)
+	ipv6Pool.Reserve(net.ParseIP("fd00::1"), gatewayMAC)
+	sw, _ := secureSwitch(t, testPool(t), ipv6Pool, 1)
+	ctx := context.Background()
+
+	sw.rxView(ctx, 0, neighborAdvertisement(mac1, "fe80::5894:efff:fee4:cee"))
+	sw.rxView(ctx, 0, neighborAdvertisement(mac1, "fd00::1"))
+	assert.Equal(t, map[int]uint64{0: 1}, sw.Violations())
+}
+
+func ipv6Frame(src tcpip.LinkAddress, ip string) *buffer.View {
+	frame := make([]byte, header.EthernetMinimumSize+header.IPv6MinimumSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{SrcAddr: src, DstAddr: gatewayLinkAddress, Type: header.IPv6ProtocolNumber})
+	header.IPv6(frame[header.EthernetMinimumSize:]).Encode(&header.IPv6Fields{
+		TransportProtocol: header.UDPProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           tcpip.AddrFrom16Slice(net.ParseIP(ip)),
+		DstAddr:           tcpip.AddrFrom16Slice(net.ParseIP("fd00::1")),
+	})
+	return buffer.NewViewWithData(frame)
+}
+
+func TestPortSecurityIPv6(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("fd00::/64")
+	ipv6Pool := NewIPPool(subnet)
+	ipv6Pool.Reserve(net.ParseIP("fd00::1"), gatewayMAC)
+	// DHCPv6 lease of a client identified by a DUID-EN
+	duid := "DUID{type=DUID-EN, enterprisenumber=43793, enterpriseidentifier=0102}"
+	leased, err := ipv6Pool.GetOrAssign(duid)
+	assert.NoError(t, err)
+	ipv6Pool.SetLinkAddress(duid, mac1.String())
+	sw, _ := secureSwitch(t, testPool(t), ipv6Pool, 2)
+	ctx := context.Background()
+
+	sw.rxView(ctx, 0, ipv6Frame(mac1, leased.String()))
+	sw.rxView(ctx, 1, ipv6Frame(mac2, leased.String()))
+	assert.Equal(t, map[int]uint64{0: 0, 1: 1}, sw.Violations())
+
+	// addresses configured without DHCPv6 belong to the first MAC address using them
+	sw.rxView(ctx, 0, ipv6Frame(mac1, "fe80::5894:efff:fee4:cee"))
+	sw.rxView(ctx, 0, ipv6Frame(mac1, "fd00::5894:efff:fee4:cee"))
+	sw.rxView(ctx, 1, ipv6Frame(mac2, "fd00::5894:efff:fee4:cee"))
+	sw.rxView(ctx, 1, neighborAdvertisement(mac2, "fd00::5894:efff:fee4:cee"))
+	assert.Equal(t, map[int]uint64{0: 0, 1: 3}, sw.Violations())
+	linkAddress, ok := sw.IPv6LinkAddress(net.ParseIP("fe80::5894:efff:fee4:cee"))
+	assert.True(t, ok)
+	assert.Equal(t, mac1, linkAddress)
+
+	// the link-local address of the gateway can't be used
+	sw.rxView(ctx, 1, ipv6Frame(mac2, "fe80::5894:efff:fee4:c01"))
+	assert.Equal(t, map[int]uint64{0: 0, 1: 4}, sw.Violations())
+
+	// the addresses are released with the port
+	sw.connLock.Lock()
+	sw.disconnect(0, &net.UnixConn{})
+	sw.connLock.Unlock()
+	_, ok = sw.IPv6LinkAddress(net.ParseIP("fe80::5894:efff:fee4:cee"))
+	assert.False(t, ok)
+	sw.rxView(ctx, 1, ipv6Frame(mac2, "fd00::5894:efff:fee4:cee"))
+	assert.Equal(t, map[int]uint64{1: 4}, sw.Violations())
+}
+
+func TestPortSecurityDisabled(t *testing.T) {
+	sw, gateway := secureSwitch(t, nil, nil, 1)
+	ctx := context.Background()
+
+	sw.rxView(ctx, 0, ipv4Frame(mac1, "192.168.127.3"))
+	sw.rxView(ctx, 0, gratuitousARP(mac1, "192.168.127.1"))
+	assert.Equal(t, map[int]uint64{0: 0}, sw.Violations())
+	assert.Equal(t, 2, gateway.delivered)
+}
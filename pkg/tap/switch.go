@@ -3,10 +3,12 @@ package tap
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	"github.com/google/gopacket"
@@ -29,6 +31,9 @@ type NetworkSwitch interface {
 	DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr)
 }
 
+// DefaultTxQueueLength is the number of packets waiting to be sent to a port when not configured.
+const DefaultTxQueueLength = 512
+
 type Switch struct {
 	Sent     uint64
 	Received uint64
@@ -36,33 +41,88 @@ type Switch struct {
 	debug               bool
 	maxTransmissionUnit int
 
+	txQueueLength int
+	txDropPolicy  types.TxDropPolicy
+
+	datagramBatchSize int
+
 	nextConnID int
-	conns      map[int]protocolConn
+	conns      map[int]*port
 	connLock   sync.Mutex
 
-	cam     map[tcpip.LinkAddress]int
-	camLock sync.RWMutex
+	cam             map[tcpip.LinkAddress]camEntry
+	camAgingTime    time.Duration
+	camMaxAddresses int
+	camLock         sync.RWMutex
 
-	writeLock sync.Mutex
+	// port security, disabled when nil, and the port of each MAC address. Both use the CAM lock.
+	security *portSecurity
+	bindings map[tcpip.LinkAddress]int
 
 	gateway VirtualDevice
+
+	now func() time.Time
 }
 
 func NewSwitch(debug bool, mtu int) *Switch {
 	return &Switch{
 		debug:               debug,
 		maxTransmissionUnit: mtu,
-		conns:               make(map[int]protocolConn),
-		cam:                 make(map[tcpip.LinkAddress]int),
+		txQueueLength:       DefaultTxQueueLength,
+		txDropPolicy:        types.TailDrop,
+		datagramBatchSize:   DefaultDatagramBatchSize,
+		conns:               make(map[int]*port),
+		cam:                 make(map[tcpip.LinkAddress]camEntry),
+		bindings:            make(map[tcpip.LinkAddress]int),
+		camAgingTime:        DefaultCAMAgingTime,
+		now:                 time.Now,
+	}
+}
+
+// SetTxQueue changes the length and the drop policy of the transmit queues of the ports connected afterwards.
+func (e *Switch) SetTxQueue(length int, policy types.TxDropPolicy) error {
+	switch policy {
+	case "":
+		policy = types.TailDrop
+	case types.TailDrop, types.HeadDrop:
+	default:
+		return fmt.Errorf("unknown drop policy %q", policy)
+	}
+	if length < 0 {
+		return fmt.Errorf("invalid transmit queue length %d", length)
+	}
+	if length == 0 {
+		length = DefaultTxQueueLength
+	}
+	e.connLock.Lock()
+	defer e.connLock.Unlock()
+	e.txQueueLength = length
+	e.txDropPolicy = policy
+	return nil
+}
+
+// SetDatagramBatchSize changes the number of frames moved with one system call on the datagram sockets connected
+// afterwards, on Linux. Batches are disabled with 1.
+func (e *Switch) SetDatagramBatchSize(size int) error {
+	if size < 0 {
+		return fmt.Errorf("invalid batch size %d", size)
 	}
+	if size == 0 {
+		size = DefaultDatagramBatchSize
+	}
+	e.connLock.Lock()
+	defer e.connLock.Unlock()
+	e.datagramBatchSize = size
+	return nil
 }
 
-func (e *Switch) CAM() map[string]int {
-	e.camLock.RLock()
-	defer e.camLock.RUnlock()
-	ret := make(map[string]int)
-	for address, port := range e.cam {
-		ret[address.String()] = port
+// Drops returns the number of packets dropped because their transmit queue was full, indexed by port.
+func (e *Switch) Drops() map[int]uint64 {
+	e.connLock.Lock()
+	defer e.connLock.Unlock()
+	ret := make(map[int]uint64)
+	for id, port := range e.conns {
+		ret[id] = atomic.LoadUint64(&port.dropped)
 	}
 	return ret
 }
@@ -79,6 +139,15 @@ func (e *Switch) DeliverNetworkPacket(_ tcpip.NetworkProtocolNumber, pkt stack.P
 
 func (e *Switch) Accept(ctx context.Context, rawConn net.Conn, protocol types.Protocol) error {
 	conn := protocolConn{Conn: rawConn, protocolImpl: protocolImplementation(protocol)}
+	e.connLock.Lock()
+	batchSize := e.datagramBatchSize
+	e.connLock.Unlock()
+	if !conn.protocolImpl.Stream() && batchSize > 1 {
+		if batch, ok := newBatchConn(rawConn); ok {
+			conn.batch = batch
+			conn.batchSize = batchSize
+		}
+	}
 	log.Infof("new connection from %s to %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
 	id, failed := e.connect(conn)
 	if failed {
@@ -106,98 +175,138 @@ func (e *Switch) connect(conn protocolConn) (int, bool) {
 	id := e.nextConnID
 	e.nextConnID++
 
-	e.conns[id] = conn
+	p := newPort(conn, e.txQueueLength, e.txDropPolicy)
+	e.conns[id] = p
+	go e.txLoop(id, p)
 	return id, false
 }
 
 func (e *Switch) tx(pkt stack.PacketBufferPtr) error {
-	return e.txPkt(pkt)
+	return e.txPkt(-1, pkt)
 }
 
-func (e *Switch) txPkt(pkt stack.PacketBufferPtr) error {
-	e.writeLock.Lock()
-	defer e.writeLock.Unlock()
-
+// txPkt queues the packet coming from the port srcID (-1 for the gateway) on the ports of its destination.
+// Multicast and unknown unicast frames are flooded to all the other ports, except unknown unicast with port security.
+// It never waits for the virtual machines.
+func (e *Switch) txPkt(srcID int, pkt stack.PacketBufferPtr) error {
 	e.connLock.Lock()
 	defer e.connLock.Unlock()
 
-	buf := pkt.ToView().AsSlice()
-	eth := header.Ethernet(buf)
+	eth := ethernetHeader(pkt)
+	if eth == nil {
+		return errors.New("packet without ethernet header")
+	}
 	dst := eth.DestinationAddress()
-	src := eth.SourceAddress()
 
-	if dst == header.EthernetBroadcastAddress {
-		e.camLock.RLock()
-		srcID, ok := e.cam[src]
-		if !ok {
-			srcID = -1
-		}
-		e.camLock.RUnlock()
-		for id, conn := range e.conns {
-			if id == srcID {
-				continue
-			}
-
-			err := e.txBuf(id, conn, buf)
-			if err != nil {
-				return err
+	if !header.IsMulticastEthernetAddress(dst) {
+		if id, ok := e.lookup(dst); ok {
+			if port, ok := e.conns[id]; ok && id != srcID {
+				port.enqueue(pkt)
 			}
-
-			atomic.AddUint64(&e.Sent, uint64(pkt.Size()))
+			return nil
 		}
-	} else {
-		e.camLock.RLock()
-		id, ok := e.cam[dst]
-		if !ok {
-			e.camLock.RUnlock()
+		if !e.flooding() {
 			return nil
 		}
-		e.camLock.RUnlock()
-		conn := e.conns[id]
-		err := e.txBuf(id, conn, buf)
-		if err != nil {
-			return err
+	}
+	for id, port := range e.conns {
+		if id == srcID {
+			continue
 		}
-		atomic.AddUint64(&e.Sent, uint64(pkt.Size()))
+		port.enqueue(pkt)
 	}
 	return nil
 }
 
-func (e *Switch) txBuf(id int, conn protocolConn, buf []byte) error {
-	if conn.protocolImpl.Stream() {
-		size := conn.protocolImpl.(streamProtocol).Buf()
-		conn.protocolImpl.(streamProtocol).Write(size, len(buf))
+// ethernetHeader returns the header pushed by the link endpoint of the gateway, or the beginning of the packets
+// received from the virtual machines. It is nil when the packet is too short.
+func ethernetHeader(pkt stack.PacketBufferPtr) header.Ethernet {
+	if eth := pkt.LinkHeader().Slice(); len(eth) >= header.EthernetMinimumSize {
+		return eth
+	}
+	eth, ok := pkt.Data().PullUp(header.EthernetMinimumSize)
+	if !ok {
+		return nil
+	}
+	return eth
+}
+
+// txLoop writes the packets queued on a port until it is disconnected.
+// With batches, the packets already queued are written together.
+func (e *Switch) txLoop(id int, p *port) {
+	for pkt := range p.queue {
+		pkts := append(p.pending[:0], pkt)
+		if p.conn.batch != nil {
+		batch:
+			for len(pkts) < p.conn.batchSize {
+				select {
+				case next, ok := <-p.queue:
+					if !ok {
+						break batch
+					}
+					pkts = append(pkts, next)
+				default:
+					break batch
+				}
+			}
+		}
+		p.pending = pkts
 
-		if _, err := conn.Write(append(size, buf...)); err != nil {
-			e.disconnect(id, conn)
-			return err
+		size := 0
+		for _, pkt := range pkts {
+			size += pkt.Size()
 		}
-	} else {
-		if _, err := conn.Write(buf); err != nil {
-			e.disconnect(id, conn)
-			return err
+		err := p.writePackets(pkts)
+		for i, pkt := range pkts {
+			pkt.DecRef()
+			pkts[i] = nil
 		}
+		if err != nil {
+			e.connLock.Lock()
+			if e.conns[id] == p {
+				log.Error(errors.Wrapf(err, "cannot send packets to %s, disconnecting", p.conn.RemoteAddr().String()))
+				e.disconnect(id, p.conn)
+			}
+			e.connLock.Unlock()
+			p.drain()
+			return
+		}
+		atomic.AddUint64(&e.Sent, uint64(size))
 	}
-	return nil
 }
 
+// disconnect removes the port from the switch. The connection lock must be held.
 func (e *Switch) disconnect(id int, conn net.Conn) {
 	e.camLock.Lock()
 	defer e.camLock.Unlock()
 
-	for address, targetConn := range e.cam {
-		if targetConn == id {
+	for address, entry := range e.cam {
+		if entry.port == id {
 			delete(e.cam, address)
 		}
 	}
+	for address, owner := range e.bindings {
+		if owner == id {
+			delete(e.bindings, address)
+			if e.security != nil {
+				e.security.release(address)
+			}
+		}
+	}
 	_ = conn.Close()
-	delete(e.conns, id)
+	if p, ok := e.conns[id]; ok {
+		close(p.queue)
+		delete(e.conns, id)
+	}
 }
 
 func (e *Switch) rx(ctx context.Context, id int, conn protocolConn) error {
 	if conn.protocolImpl.Stream() {
 		return e.rxStream(ctx, id, conn, conn.protocolImpl.(streamProtocol))
 	}
+	if conn.batch != nil {
+		return e.rxBatch(ctx, id, conn.batch, conn.batchSize)
+	}
 	return e.rxNonStream(ctx, id, conn)
 }
 
@@ -216,7 +325,7 @@ loop:
 		if err != nil {
 			return errors.Wrap(err, "cannot read size from socket")
 		}
-		e.rxBuf(ctx, id, buf[:n])
+		e.rxView(ctx, id, buffer.NewViewWithData(buf[:n]))
 	}
 	return nil
 }
@@ -238,42 +347,57 @@ loop:
 		}
 		size := sProtocol.Read(sizeBuf)
 
-		buf := make([]byte, size)
-		_, err = io.ReadFull(reader, buf)
+		// pooled, released when the packets using it are
+		view := buffer.NewViewSize(size)
+		_, err = io.ReadFull(reader, view.AsSlice())
 		if err != nil {
+			view.Release()
 			return errors.Wrap(err, "cannot read packet from socket")
 		}
-		e.rxBuf(ctx, id, buf)
+		e.rxView(ctx, id, view)
 	}
 	return nil
 }
 
-func (e *Switch) rxBuf(_ context.Context, id int, buf []byte) {
+// rxView switches a frame received from a virtual machine, and takes the ownership of its view.
+// The packets sent to the other virtual machines and to the gateway share it without copy.
+func (e *Switch) rxView(_ context.Context, id int, view *buffer.View) {
+	buf := view.AsSlice()
+	if len(buf) < header.EthernetMinimumSize {
+		view.Release()
+		return
+	}
+	data := buffer.MakeWithView(view)
+	defer data.Release()
+
 	if e.debug {
 		packet := gopacket.NewPacket(buf, layers.LayerTypeEthernet, gopacket.Default)
 		log.Info(packet.String())
 	}
 
 	eth := header.Ethernet(buf)
+	if !e.secure(id, eth) {
+		return
+	}
 
-	e.camLock.Lock()
-	e.cam[eth.SourceAddress()] = id
-	e.camLock.Unlock()
+	if !header.IsMulticastEthernetAddress(eth.SourceAddress()) && !e.learn(eth.SourceAddress(), id) {
+		return
+	}
 
 	if eth.DestinationAddress() != e.gateway.LinkAddress() {
 		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			Payload: buffer.MakeWithData(buf),
+			Payload: data.Clone(),
 		})
-		if err := e.tx(pkt); err != nil {
+		if err := e.txPkt(id, pkt); err != nil {
 			log.Error(err)
 		}
 		pkt.DecRef()
 	}
-	if eth.DestinationAddress() == e.gateway.LinkAddress() || eth.DestinationAddress() == header.EthernetBroadcastAddress {
-		data := buffer.MakeWithData(buf)
-		data.TrimFront(header.EthernetMinimumSize)
+	if eth.DestinationAddress() == e.gateway.LinkAddress() || header.IsMulticastEthernetAddress(eth.DestinationAddress()) {
+		payload := data.Clone()
+		payload.TrimFront(header.EthernetMinimumSize)
 		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			Payload: data,
+			Payload: payload,
 		})
 		e.gateway.DeliverNetworkPacket(eth.Type(), pkt)
 		pkt.DecRef()
@@ -0,0 +1,117 @@
+package tap
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func broadcastFrame(n byte) stack.PacketBufferPtr {
+	frame := make([]byte, header.EthernetMinimumSize+1)
+	copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xdd})
+	frame[header.EthernetMinimumSize] = n
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(frame),
+	})
+}
+
+func TestSlowPortDoesNotBlockOthers(t *testing.T) {
+	sw := NewSwitch(false, 1500)
+	assert.NoError(t, sw.SetTxQueue(2, types.TailDrop))
+
+	// nobody reads on the stuck port
+	stuck, stuckPeer := net.Pipe()
+	defer stuckPeer.Close()
+	fast, fastPeer := net.Pipe()
+	defer fastPeer.Close()
+	go func() { _ = sw.Accept(context.Background(), stuck, types.BessProtocol) }()
+	go func() { _ = sw.Accept(context.Background(), fast, types.BessProtocol) }()
+	assert.Eventually(t, func() bool { return len(sw.Drops()) == 2 }, time.Second, 10*time.Millisecond)
+
+	received := make(chan byte, 10)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, err := fastPeer.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- buf[n-1]
+		}
+	}()
+
+	for i := byte(0); i < 10; i++ {
+		pkt := broadcastFrame(i)
+		assert.NoError(t, sw.tx(pkt))
+		pkt.DecRef()
+		select {
+		case n := <-received:
+			assert.Equal(t, i, n)
+		case <-time.After(time.Second):
+			t.Fatalf("packet %d not received", i)
+		}
+	}
+
+	var dropped uint64
+	for _, drops := range sw.Drops() {
+		dropped += drops
+	}
+	// two packets are queued, and one may be being written
+	assert.GreaterOrEqual(t, dropped, uint64(7))
+	assert.LessOrEqual(t, dropped, uint64(8))
+}
+
+func TestDropPolicy(t *testing.T) {
+	tail := newPort(protocolConn{}, 2, types.TailDrop)
+	head := newPort(protocolConn{}, 2, types.HeadDrop)
+	var pkts []stack.PacketBufferPtr
+	for i := byte(1); i <= 3; i++ {
+		pkts = append(pkts, broadcastFrame(i))
+	}
+	for _, p := range []*port{tail, head} {
+		for _, pkt := range pkts {
+			p.enqueue(pkt)
+		}
+	}
+	assert.Equal(t, pkts[0], <-tail.queue)
+	assert.Equal(t, pkts[1], <-tail.queue)
+	assert.Equal(t, uint64(1), tail.dropped)
+	assert.Equal(t, pkts[1], <-head.queue)
+	assert.Equal(t, pkts[2], <-head.queue)
+	assert.Equal(t, uint64(1), head.dropped)
+
+	assert.Error(t, NewSwitch(false, 1500).SetTxQueue(1, "random"))
+}
+
+func TestVectoredWrite(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	p := newPort(protocolConn{Conn: conn, protocolImpl: &qemuProtocol{}}, 1, types.TailDrop)
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: header.EthernetMinimumSize,
+		Payload:            buffer.MakeWithData([]byte{1, 2, 3}),
+	})
+	defer pkt.DecRef()
+	copy(pkt.LinkHeader().Push(header.EthernetMinimumSize), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	go func() {
+		assert.NoError(t, p.write(pkt))
+		assert.NoError(t, p.write(pkt))
+	}()
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, 4+header.EthernetMinimumSize+3)
+		_, err := io.ReadFull(peer, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 17}, buf[:4])
+		assert.Equal(t, []byte{1, 2, 3}, buf[4+header.EthernetMinimumSize:])
+	}
+}
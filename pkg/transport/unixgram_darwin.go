@@ -6,20 +6,208 @@ package transport
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
-type connectedUnixgramConn struct {
-	*net.UnixConn
+var vfkitMagic = []byte("VFKT")
+
+// vfkitListener demultiplexes the datagrams received on a listening unixgram socket.
+// Each vfkit process starts by sending the VFKT magic from its own socket, this is used
+// to accept a new connection for this peer. When a known peer sends the magic again,
+// the VM was restarted and its previous connection is closed.
+type vfkitListener struct {
+	conn *net.UnixConn
+
+	conns     map[string]*vfkitConn
+	connsLock sync.Mutex
+
+	accept    chan *vfkitConn
+	done      chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewVfkitListener(conn *net.UnixConn) (net.Listener, error) {
+	if err := setBufferSizes(conn); err != nil {
+		return nil, err
+	}
+
+	ln := &vfkitListener{
+		conn:    conn,
+		conns:   make(map[string]*vfkitConn),
+		accept:  make(chan *vfkitConn),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go ln.readLoop()
+	return ln, nil
+}
+
+func (ln *vfkitListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.accept:
+		return conn, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *vfkitListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.closing) })
+	return ln.conn.Close()
+}
+
+func (ln *vfkitListener) Addr() net.Addr {
+	return ln.conn.LocalAddr()
+}
+
+func (ln *vfkitListener) readLoop() {
+	defer func() {
+		ln.connsLock.Lock()
+		defer ln.connsLock.Unlock()
+		for _, conn := range ln.conns {
+			conn.closeOnce.Do(func() { close(conn.closed) })
+		}
+		close(ln.done)
+	}()
+
+	buf := make([]byte, 1024*128)
+	for {
+		n, addr, err := ln.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("cannot read from vfkit socket: %v", err)
+			}
+			return
+		}
+		unixAddr, ok := addr.(*net.UnixAddr)
+		if !ok {
+			log.Errorf("unexpected type for vfkit unix sockaddr: %T", addr)
+			continue
+		}
+
+		if bytes.Equal(buf[:n], vfkitMagic) {
+			conn := ln.newConn(unixAddr)
+			select {
+			case ln.accept <- conn:
+			case <-ln.closing:
+				return
+			}
+			continue
+		}
+
+		ln.connsLock.Lock()
+		conn, ok := ln.conns[unixAddr.String()]
+		ln.connsLock.Unlock()
+		if !ok {
+			log.Errorf("dropping packet from vfkit peer %s, no magic received", unixAddr.String())
+			continue
+		}
+
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		select {
+		case conn.packets <- pkt:
+		case <-conn.closed:
+		default:
+			log.Debugf("dropping packet from vfkit peer %s, receive queue is full", unixAddr.String())
+		}
+	}
+}
+
+// newConn registers a connection for remoteAddr, replacing any previous one.
+func (ln *vfkitListener) newConn(remoteAddr *net.UnixAddr) *vfkitConn {
+	ln.connsLock.Lock()
+	defer ln.connsLock.Unlock()
+
+	if previous, ok := ln.conns[remoteAddr.String()]; ok {
+		log.Infof("vfkit peer %s reconnected", remoteAddr.String())
+		previous.closeOnce.Do(func() { close(previous.closed) })
+	}
+	conn := &vfkitConn{
+		listener:   ln,
+		remoteAddr: remoteAddr,
+		packets:    make(chan []byte, 1024),
+		closed:     make(chan struct{}),
+	}
+	ln.conns[remoteAddr.String()] = conn
+	return conn
+}
+
+func (ln *vfkitListener) removeConn(conn *vfkitConn) {
+	ln.connsLock.Lock()
+	defer ln.connsLock.Unlock()
+
+	if ln.conns[conn.remoteAddr.String()] == conn {
+		delete(ln.conns, conn.remoteAddr.String())
+	}
+}
+
+// vfkitConn is the connection with a single vfkit process, sharing the listening socket.
+type vfkitConn struct {
+	listener   *vfkitListener
 	remoteAddr *net.UnixAddr
+
+	packets   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (conn *vfkitConn) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-conn.packets:
+		return copy(b, pkt), nil
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (conn *vfkitConn) Write(b []byte) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return conn.listener.conn.WriteTo(b, conn.remoteAddr)
+}
+
+func (conn *vfkitConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	conn.listener.removeConn(conn)
+	return nil
+}
+
+func (conn *vfkitConn) LocalAddr() net.Addr {
+	return conn.listener.conn.LocalAddr()
+}
+
+func (conn *vfkitConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *vfkitConn) SetDeadline(_ time.Time) error {
+	return errors.New("deadlines are not supported on vfkit connections")
 }
 
-func connectListeningUnixgramConn(conn *net.UnixConn, remoteAddr *net.UnixAddr) (*connectedUnixgramConn, error) {
+func (conn *vfkitConn) SetReadDeadline(_ time.Time) error {
+	return errors.New("deadlines are not supported on vfkit connections")
+}
+
+func (conn *vfkitConn) SetWriteDeadline(_ time.Time) error {
+	return errors.New("deadlines are not supported on vfkit connections")
+}
+
+func setBufferSizes(conn *net.UnixConn) error {
 	rawConn, err := conn.SyscallConn()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	err = rawConn.Control(func(fd uintptr) {
 		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, 1*1024*1024); err != nil {
@@ -29,14 +217,12 @@ func connectListeningUnixgramConn(conn *net.UnixConn, remoteAddr *net.UnixAddr)
 			return
 		}
 	})
-	if err != nil {
-		return nil, err
-	}
+	return err
+}
 
-	return &connectedUnixgramConn{
-		UnixConn:   conn,
-		remoteAddr: remoteAddr,
-	}, nil
+type connectedUnixgramConn struct {
+	*net.UnixConn
+	remoteAddr *net.UnixAddr
 }
 
 func (conn *connectedUnixgramConn) RemoteAddr() net.Addr {
@@ -47,21 +233,31 @@ func (conn *connectedUnixgramConn) Write(b []byte) (int, error) {
 	return conn.WriteTo(b, conn.remoteAddr)
 }
 
+// AcceptVfkit waits for the magic of a single vfkit process and returns its connection.
+//
+// Deprecated: use NewVfkitListener, it keeps accepting the vfkit processes, for instance after a restart of the VM.
 func AcceptVfkit(listeningConn *net.UnixConn) (net.Conn, error) {
-	vfkitMagic := make([]byte, 4)
+	magic := make([]byte, len(vfkitMagic))
 	// the main reason for this magic check is to get the address to use to send data to the vfkit VM
-	bytesRead, vfkitAddr, err := listeningConn.ReadFrom(vfkitMagic)
-	if bytesRead != len(vfkitMagic) {
-		return nil, fmt.Errorf("invalid magic length: %d", len(vfkitMagic))
+	bytesRead, vfkitAddr, err := listeningConn.ReadFrom(magic)
+	if bytesRead != len(magic) {
+		return nil, fmt.Errorf("invalid magic length: %d", len(magic))
 	}
 	if err != nil {
 		return nil, err
 	}
-	if _, ok := vfkitAddr.(*net.UnixAddr); !ok {
-		return nil, fmt.Errorf("unexpected type for vfkit unix sockaddr: %t", vfkitAddr)
+	remoteAddr, ok := vfkitAddr.(*net.UnixAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type for vfkit unix sockaddr: %T", vfkitAddr)
 	}
-	if !bytes.Equal(vfkitMagic, []byte("VFKT")) {
-		return nil, fmt.Errorf("invalid magic from the vfkit process: %s", hex.EncodeToString(vfkitMagic))
+	if !bytes.Equal(magic, vfkitMagic) {
+		return nil, fmt.Errorf("invalid magic from the vfkit process: %s", hex.EncodeToString(magic))
 	}
-	return connectListeningUnixgramConn(listeningConn, vfkitAddr.(*net.UnixAddr))
+	if err := setBufferSizes(listeningConn); err != nil {
+		return nil, err
+	}
+	return &connectedUnixgramConn{
+		UnixConn:   listeningConn,
+		remoteAddr: remoteAddr,
+	}, nil
 }
@@ -12,6 +12,11 @@ func ListenUnixgram(_ string) (net.Conn, error) {
 	return nil, errors.New("unsupported 'unixgram' scheme")
 }
 
+func NewVfkitListener(_ net.Conn) (net.Listener, error) {
+	return nil, errors.New("vfkit is unsupported on this platform")
+}
+
+// Deprecated: use NewVfkitListener.
 func AcceptVfkit(_ net.Conn) (net.Conn, error) {
 	return nil, errors.New("vfkit is unsupported on this platform")
 }
@@ -7,49 +7,122 @@ import (
 
 type Configuration struct {
 	// Print packets on stderr
-	Debug bool
+	Debug bool `yaml:"debug,omitempty"`
 
 	// Record all packets coming in and out in a file that can be read by Wireshark (pcap)
-	CaptureFile string
+	CaptureFile string `yaml:"captureFile,omitempty"`
 
 	// Length of packet
 	// Larger packets means less packets to exchange for the same amount of data (and less protocol overhead)
-	MTU int
+	MTU int `yaml:"mtu,omitempty"`
 
 	// Network reserved for the virtual network
-	Subnet string
+	Subnet string `yaml:"subnet,omitempty"`
 
 	// IP address of the virtual gateway
-	GatewayIP string
+	GatewayIP string `yaml:"gatewayIP,omitempty"`
+
+	// IPv6 network reserved for the virtual network. IPv6 is disabled when empty.
+	IPv6Subnet string `yaml:"ipv6Subnet,omitempty"`
+
+	// IPv6 address of the virtual gateway
+	IPv6GatewayIP string `yaml:"ipv6GatewayIP,omitempty"`
+
+	// Assign IPv6 addresses with DHCPv6 instead of SLAAC.
+	// Router advertisements then set the managed flag and no longer allow autoconfiguration.
+	DHCPv6Stateful bool `yaml:"dhcpv6Stateful,omitempty"`
 
 	// MAC address of the virtual gateway
-	GatewayMacAddress string
+	GatewayMacAddress string `yaml:"gatewayMacAddress,omitempty"`
 
 	// Built-in DNS records that will be served by the DNS server embedded in the gateway
-	DNS []Zone
+	DNS []Zone `yaml:"dns,omitempty"`
 
 	// List of search domains that will be added in all DHCP replies
-	DNSSearchDomains []string
+	DNSSearchDomains []string `yaml:"dnsSearchDomains,omitempty"`
+
+	// Nameservers (IP or IP:port) queried for the names outside of the built-in zones, in order.
+	// Their responses are cached. The resolver of the host is used when empty.
+	DNSUpstreamServers []string `yaml:"dnsUpstreamServers,omitempty"`
+
+	// Forward the queries outside of the built-in zones to the upstream servers without altering them,
+	// and relay the responses as is. Useful for DNSSEC and record types not known by the gateway.
+	DNSPassthrough bool `yaml:"dnsPassthrough,omitempty"`
 
 	// Port forwarding between the machine running the gateway and the virtual network.
-	Forwards map[string]string
+	Forwards map[string]string `yaml:"forwards,omitempty"`
 
 	// Address translation of incoming traffic.
 	// Useful for reaching the host itself (localhost) from the virtual network.
-	NAT map[string]string
+	NAT map[string]string `yaml:"nat,omitempty"`
+
+	// Proxy used by the gateway to open the TCP connections of the virtual machines. Connections are direct when nil.
+	OutboundProxy *OutboundProxy `yaml:"outboundProxy,omitempty"`
+
+	// Policy applied to the TCP connections, UDP flows and pings of the virtual machines, before they reach the network.
+	// Everything is allowed when nil.
+	Firewall *Firewall `yaml:"firewall,omitempty"`
 
 	// IPs assigned to the gateway that can answer to ARP requests
-	GatewayVirtualIPs []string
+	GatewayVirtualIPs []string `yaml:"gatewayVirtualIPs,omitempty"`
 
 	// DHCP static leases. Allow to assign pre-defined IP to virtual machine based on the MAC address
-	DHCPStaticLeases map[string]string
+	DHCPStaticLeases map[string]string `yaml:"dhcpStaticLeases,omitempty"`
+
+	// File where the DHCP leases are saved, so that virtual machines get the same IP after a restart of the gateway.
+	// Leases are only kept in memory when empty.
+	DHCPLeaseFile string `yaml:"dhcpLeaseFile,omitempty"`
+
+	// DNS zone where the hostnames sent by the DHCP clients are registered, like vm.containers.internal.
+	// Hostnames are resolved to the leased address until the lease is released or expires. Disabled when empty.
+	DHCPHostnameZone string `yaml:"dhcpHostnameZone,omitempty"`
+
+	// Run a SNTP server on the gateway answering with the clock of the host.
+	// It is advertised to the virtual machines with the DHCP option 42.
+	NTP bool `yaml:"ntp,omitempty"`
+
+	// Directory of the host served by the TFTP server of the gateway. TFTP is disabled when empty.
+	TFTPRoot string `yaml:"tftpRoot,omitempty"`
+
+	// Additional options of the DHCP replies, they take precedence over the built-in ones
+	DHCPOptions *DHCPOptions `yaml:"dhcpOptions,omitempty"`
+
+	// DHCP options of specific virtual machines, indexed by MAC address. They take precedence over DHCPOptions.
+	DHCPHostOptions map[string]DHCPOptions `yaml:"dhcpHostOptions,omitempty"`
+
+	// Cloud metadata service (EC2 and OpenStack compatible) answering on 169.254.169.254:80, used by cloud-init.
+	// Disabled when nil.
+	Metadata *Metadata `yaml:"metadata,omitempty"`
 
 	// Only for Hyperkit
 	// Allow to assign a pre-defined MAC address to an Hyperkit VM
-	VpnKitUUIDMacAddresses map[string]string
+	VpnKitUUIDMacAddresses map[string]string `yaml:"vpnkitUUIDMacAddresses,omitempty"`
 
 	// Protocol to be used. Only for /connect mux
-	Protocol Protocol
+	Protocol Protocol `yaml:"protocol,omitempty"`
+
+	// Number of packets waiting to be sent to each virtual machine, 512 when 0.
+	// A slow virtual machine only fills its own queue and doesn't slow down the others.
+	TxQueueLength int `yaml:"txQueueLength,omitempty"`
+
+	// Packets dropped when the transmit queue of a virtual machine is full, tail when empty
+	TxDropPolicy TxDropPolicy `yaml:"txDropPolicy,omitempty"`
+
+	// Seconds after which the switch forgets the MAC addresses it doesn't see anymore, 300 when 0.
+	// Frames for unknown addresses are sent to all the virtual machines.
+	CAMAgingTime int `yaml:"camAgingTime,omitempty"`
+
+	// Number of MAC addresses learnt by the switch on the connection of each virtual machine, without limit when 0.
+	// The frames of the other addresses are dropped.
+	CAMMaxAddresses int `yaml:"camMaxAddresses,omitempty"`
+
+	// Number of frames moved with one system call on the unixgram and unixpacket sockets (vfkit and bess protocols),
+	// only on Linux. 32 when 0, batches are disabled with 1.
+	DatagramBatchSize int `yaml:"datagramBatchSize,omitempty"`
+
+	// Drop the frames of the virtual machines using the MAC address of another one or of the gateway, or an IPv4
+	// address not leased to them by DHCP or with a static lease.
+	PortSecurity bool `yaml:"portSecurity,omitempty"`
 }
 
 type Protocol string
@@ -67,14 +140,212 @@ const (
 	VfkitProtocol Protocol = "vfkit"
 )
 
+type TxDropPolicy string
+
+const (
+	// TailDrop discards the packets which don't fit in the queue
+	TailDrop TxDropPolicy = "tail"
+	// HeadDrop discards the oldest packets of the queue to make room for the new ones
+	HeadDrop TxDropPolicy = "head"
+)
+
+type DHCPOptions struct {
+	// NTP servers (option 42)
+	NTPServers []string `yaml:"ntpServers,omitempty"`
+
+	// Host name of the client (option 12)
+	Hostname string `yaml:"hostname,omitempty"`
+
+	// Domain name of the client (option 15)
+	DomainName string `yaml:"domainName,omitempty"`
+
+	// Classless static routes (option 121).
+	// Clients ignore the router option when it is set, so a default route through the gateway is added if missing.
+	Routes []Route `yaml:"routes,omitempty"`
+
+	// File loaded by PXE clients (option 67 and file field)
+	BootFile string `yaml:"bootFile,omitempty"`
+
+	// TFTP server of the boot file (option 66 and next server field), the gateway when empty
+	TFTPServer string `yaml:"tftpServer,omitempty"`
+
+	// Vendor specific information (option 43), hex encoded
+	VendorSpecific string `yaml:"vendorSpecific,omitempty"`
+
+	// Other options, hex encoded values indexed by option code
+	Raw map[uint8]string `yaml:"raw,omitempty"`
+}
+
+type Route struct {
+	// Destination network, in CIDR notation
+	Destination string `yaml:"destination,omitempty"`
+
+	// Router to reach the destination, the gateway when empty
+	Gateway string `yaml:"gateway,omitempty"`
+}
+
+type OutboundProxy struct {
+	// http://[user:password@]host:port or socks5://[user:password@]host:port
+	URL string `yaml:"url,omitempty"`
+
+	// Destinations reached without proxy: IPs, networks (CIDR notation) or domains, which include their subdomains.
+	// Loopback addresses are always reached directly.
+	NoProxy []string `yaml:"noProxy,omitempty"`
+}
+
+type FirewallAction string
+
+const (
+	Allow FirewallAction = "allow"
+	Deny  FirewallAction = "deny"
+)
+
+type Firewall struct {
+	// Action applied when no rule matches, allow when empty
+	DefaultAction FirewallAction `yaml:"defaultAction,omitempty"`
+
+	// Evaluated in order, the first matching rule applies
+	Rules []FirewallRule `yaml:"rules,omitempty"`
+}
+
+// FirewallRule matches the connections having all the given properties. A rule without property matches everything.
+type FirewallRule struct {
+	Action FirewallAction `yaml:"action,omitempty"`
+
+	// tcp, udp or icmp (echo requests)
+	Protocol TransportProtocol `yaml:"protocol,omitempty"`
+
+	// Destination IP or network (CIDR notation)
+	Destination string `yaml:"destination,omitempty"`
+
+	// Destination port, or range of ports like 8000-8999
+	Ports string `yaml:"ports,omitempty"`
+
+	// Name of the destination resolved by the DNS server of the gateway.
+	// *.example.com matches the subdomains of example.com.
+	Name string `yaml:"name,omitempty"`
+}
+
+type Metadata struct {
+	// Served to the virtual machines without instance
+	Default MetadataInstance `yaml:"default,omitempty"`
+
+	// Served to the virtual machine with the same MAC address, PortSecurity must be enabled
+	Instances []MetadataInstance `yaml:"instances,omitempty"`
+}
+
+type MetadataInstance struct {
+	// MAC address of the virtual machine, empty for the default instance
+	MAC string `yaml:"mac,omitempty"`
+
+	// Derived from the MAC address when empty
+	InstanceID string `yaml:"instanceID,omitempty"`
+
+	// Hostname sent by the DHCP client, or derived from the IP address when empty
+	Hostname string `yaml:"hostname,omitempty"`
+
+	// SSH public keys, in authorized_keys format
+	PublicKeys []string `yaml:"publicKeys,omitempty"`
+
+	// Usually a cloud-config document or a script
+	UserData string `yaml:"userData,omitempty"`
+}
+
 type Zone struct {
-	Name      string
-	Records   []Record
-	DefaultIP net.IP
+	Name      string   `yaml:"name,omitempty"`
+	Records   []Record `yaml:"records,omitempty"`
+	DefaultIP net.IP   `yaml:"defaultIP,omitempty"`
 }
 
+// Record is a DNS record of a zone. Its type depends on the field set among IP, CNAME, TXT, SRV and PTR.
 type Record struct {
-	Name   string
-	IP     net.IP
-	Regexp *regexp.Regexp
+	Name   string         `yaml:"name,omitempty"`
+	Regexp *regexp.Regexp `yaml:"regexp,omitempty"`
+
+	// A record, or AAAA record for IPv6 addresses
+	IP net.IP `yaml:"ip,omitempty"`
+	// Canonical name (fully qualified) the name is an alias of
+	CNAME string   `yaml:"cname,omitempty"`
+	TXT   []string `yaml:"txt,omitempty"`
+	SRV   *SRV     `yaml:"srv,omitempty"`
+	// Fully qualified name of the address, for reverse zones like 127.168.192.in-addr.arpa.
+	PTR string `yaml:"ptr,omitempty"`
+
+	// Time to live of the answers, in seconds
+	TTL uint32 `yaml:"ttl,omitempty"`
+}
+
+type SRV struct {
+	Priority uint16 `yaml:"priority,omitempty"`
+	Weight   uint16 `yaml:"weight,omitempty"`
+	Port     uint16 `yaml:"port,omitempty"`
+	// Fully qualified name of the host providing the service
+	Target string `yaml:"target,omitempty"`
+}
+
+// Type returns the DNS type of the record: A, AAAA, CNAME, TXT, SRV or PTR.
+// It is empty when the record has no value.
+func (r Record) Type() string {
+	switch {
+	case r.IP != nil && r.IP.To4() != nil:
+		return "A"
+	case r.IP != nil:
+		return "AAAA"
+	case r.CNAME != "":
+		return "CNAME"
+	case len(r.TXT) > 0:
+		return "TXT"
+	case r.SRV != nil:
+		return "SRV"
+	case r.PTR != "":
+		return "PTR"
+	default:
+		return ""
+	}
+}
+
+// UnmarshalYAML compiles the regular expression of the record itself,
+// regexp.Regexp can only be decoded from text since Go 1.21. The other fields must be kept in sync with Record.
+func (r *Record) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		Name   string   `yaml:"name,omitempty"`
+		Regexp string   `yaml:"regexp,omitempty"`
+		IP     net.IP   `yaml:"ip,omitempty"`
+		CNAME  string   `yaml:"cname,omitempty"`
+		TXT    []string `yaml:"txt,omitempty"`
+		SRV    *SRV     `yaml:"srv,omitempty"`
+		PTR    string   `yaml:"ptr,omitempty"`
+		TTL    uint32   `yaml:"ttl,omitempty"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*r = Record{
+		Name:  raw.Name,
+		IP:    raw.IP,
+		CNAME: raw.CNAME,
+		TXT:   raw.TXT,
+		SRV:   raw.SRV,
+		PTR:   raw.PTR,
+		TTL:   raw.TTL,
+	}
+	if raw.Regexp != "" {
+		compiled, err := regexp.Compile(raw.Regexp)
+		if err != nil {
+			return err
+		}
+		r.Regexp = compiled
+	}
+	return nil
+}
+
+// SameName returns whether both records are for the same name or regular expression.
+func (r Record) SameName(other Record) bool {
+	if r.Name != other.Name {
+		return false
+	}
+	if r.Regexp == nil || other.Regexp == nil {
+		return r.Regexp == nil && other.Regexp == nil
+	}
+	return r.Regexp.String() == other.Regexp.String()
 }
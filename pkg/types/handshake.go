@@ -7,15 +7,36 @@ const (
 	TCP   TransportProtocol = "tcp"
 	UNIX  TransportProtocol = "unix"
 	NPIPE TransportProtocol = "npipe"
+	// echo requests, only in the firewall rules
+	ICMP TransportProtocol = "icmp"
 )
 
 type ExposeRequest struct {
 	Local    string            `json:"local"`
 	Remote   string            `json:"remote"`
 	Protocol TransportProtocol `json:"protocol"`
+	// ProxyProtocol is the version (1 or 2) of the PROXY protocol header sent on the connections to the remote
+	// service, with the address of the host-side client. It is disabled when 0.
+	ProxyProtocol int `json:"proxyProtocol,omitempty"`
 }
 
 type UnexposeRequest struct {
 	Local    string            `json:"local"`
 	Protocol TransportProtocol `json:"protocol"`
 }
+
+// NATRequest is a translation of the traffic sent by the virtual machines to VirtualIP, to HostIP.
+type NATRequest struct {
+	VirtualIP string `json:"virtualIP"`
+	HostIP    string `json:"hostIP,omitempty"`
+}
+
+// CAMEntry is an address learnt by the switch.
+type CAMEntry struct {
+	// Port of the switch the frames for the address are sent to
+	Port int `json:"port"`
+	// Address of the connection of the port
+	Remote string `json:"remote,omitempty"`
+	// Seconds since the last frame coming from the address
+	Age int `json:"age"`
+}
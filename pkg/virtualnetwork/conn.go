@@ -9,6 +9,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 )
 
 func (n *VirtualNetwork) Dial(network, addr string) (net.Conn, error) {
@@ -16,11 +17,8 @@ func (n *VirtualNetwork) Dial(network, addr string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return gonet.DialTCP(n.stack, tcpip.FullAddress{
-		NIC:  1,
-		Addr: tcpip.AddrFrom4Slice(ip.To4()),
-		Port: uint16(port),
-	}, ipv4.ProtocolNumber)
+	address, protocol := fullAddress(ip, port)
+	return gonet.DialTCP(n.stack, address, protocol)
 }
 
 func (n *VirtualNetwork) DialContextTCP(ctx context.Context, addr string) (net.Conn, error) {
@@ -29,12 +27,8 @@ func (n *VirtualNetwork) DialContextTCP(ctx context.Context, addr string) (net.C
 		return nil, err
 	}
 
-	return gonet.DialContextTCP(ctx, n.stack,
-		tcpip.FullAddress{
-			NIC:  1,
-			Addr: tcpip.AddrFrom4Slice(ip.To4()),
-			Port: uint16(port),
-		}, ipv4.ProtocolNumber)
+	address, protocol := fullAddress(ip, port)
+	return gonet.DialContextTCP(ctx, n.stack, address, protocol)
 }
 
 func (n *VirtualNetwork) Listen(network, addr string) (net.Listener, error) {
@@ -42,11 +36,8 @@ func (n *VirtualNetwork) Listen(network, addr string) (net.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return gonet.ListenTCP(n.stack, tcpip.FullAddress{
-		NIC:  1,
-		Addr: tcpip.AddrFrom4Slice(ip.To4()),
-		Port: uint16(port),
-	}, ipv4.ProtocolNumber)
+	address, protocol := fullAddress(ip, port)
+	return gonet.ListenTCP(n.stack, address, protocol)
 }
 
 func splitIPPort(network string, addr string) (net.IP, uint64, error) {
@@ -67,3 +58,23 @@ func splitIPPort(network string, addr string) (net.IP, uint64, error) {
 	}
 	return ip, port, nil
 }
+
+// fullAddress converts an IPv4 or IPv6 address to its gVisor representation on the gateway NIC.
+func fullAddress(ip net.IP, port uint64) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	address := tcpip.FullAddress{
+		NIC:  1,
+		Addr: tcpipAddress(ip),
+		Port: uint16(port),
+	}
+	if address.Addr.Len() == net.IPv4len {
+		return address, ipv4.ProtocolNumber
+	}
+	return address, ipv6.ProtocolNumber
+}
+
+func tcpipAddress(ip net.IP) tcpip.Address {
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.AddrFrom4Slice(ip4)
+	}
+	return tcpip.AddrFrom16Slice(ip.To16())
+}
@@ -0,0 +1,36 @@
+package virtualnetwork
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type packetHandler func(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) bool
+
+// packetInterceptor lets services handle packets coming from the virtual machines before the stack.
+// Handlers are registered while the services are created, before any packet is received.
+type packetInterceptor struct {
+	nested.Endpoint
+
+	handlers []packetHandler
+}
+
+func newPacketInterceptor(child stack.LinkEndpoint) *packetInterceptor {
+	e := &packetInterceptor{}
+	e.Endpoint.Init(child, e)
+	return e
+}
+
+func (e *packetInterceptor) addHandler(handler packetHandler) {
+	e.handlers = append(e.handlers, handler)
+}
+
+func (e *packetInterceptor) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	for _, handler := range e.handlers {
+		if handler(protocol, pkt) {
+			return
+		}
+	}
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
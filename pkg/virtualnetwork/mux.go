@@ -9,9 +9,7 @@ import (
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	log "github.com/sirupsen/logrus"
-	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
-	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"inet.af/tcpproxy"
 )
 
@@ -24,8 +22,17 @@ func (n *VirtualNetwork) Mux() *http.ServeMux {
 	mux.HandleFunc("/cam", func(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(n.networkSwitch.CAM())
 	})
+	mux.HandleFunc("/cam/entries", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(n.networkSwitch.CAMEntries())
+	})
+	mux.HandleFunc("/drops", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(n.networkSwitch.Drops())
+	})
+	mux.HandleFunc("/violations", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(n.networkSwitch.Violations())
+	})
 	mux.HandleFunc("/leases", func(w http.ResponseWriter, r *http.Request) {
-		_ = json.NewEncoder(w).Encode(n.ipPool.Leases())
+		_ = json.NewEncoder(w).Encode(n.leases())
 	})
 	mux.HandleFunc(types.ConnectPath, func(w http.ResponseWriter, r *http.Request) {
 		hj, ok := w.(http.Hijacker)
@@ -48,12 +55,12 @@ func (n *VirtualNetwork) Mux() *http.ServeMux {
 		_ = n.networkSwitch.Accept(context.Background(), conn, n.configuration.Protocol)
 	})
 	mux.HandleFunc("/tunnel", func(w http.ResponseWriter, r *http.Request) {
-		ip := r.URL.Query().Get("ip")
-		if ip == "" {
+		ip := net.ParseIP(r.URL.Query().Get("ip"))
+		if ip == nil {
 			http.Error(w, "ip is mandatory", http.StatusInternalServerError)
 			return
 		}
-		port, err := strconv.Atoi(r.URL.Query().Get("port"))
+		port, err := strconv.ParseUint(r.URL.Query().Get("port"), 10, 16)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -84,11 +91,8 @@ func (n *VirtualNetwork) Mux() *http.ServeMux {
 
 		remote := tcpproxy.DialProxy{
 			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
-				return gonet.DialContextTCP(ctx, n.stack, tcpip.FullAddress{
-					NIC:  1,
-					Addr: tcpip.AddrFrom4Slice(net.ParseIP(ip).To4()),
-					Port: uint16(port),
-				}, ipv4.ProtocolNumber)
+				target, protocol := fullAddress(ip, port)
+				return gonet.DialContextTCP(ctx, n.stack, target, protocol)
 			},
 			OnDialError: func(src net.Conn, dstDialErr error) {
 				log.Errorf("cannot dial: %v", dstDialErr)
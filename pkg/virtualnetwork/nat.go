@@ -0,0 +1,138 @@
+package virtualnetwork
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/pkg/errors"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// natTable holds the address translations of the traffic going out of the virtual network.
+// It is shared with the forwarders and can be changed at runtime.
+type natTable struct {
+	translation map[tcpip.Address]tcpip.Address
+	lock        sync.Mutex
+
+	// answers to ARP requests about the translated addresses
+	link *tap.LinkEndpoint
+	// virtual IPs of the configuration, they keep answering to ARP requests when their translation is removed
+	staticVirtualIPs map[string]struct{}
+}
+
+func newNATTable(configuration *types.Configuration, link *tap.LinkEndpoint, virtualIPs []string) *natTable {
+	table := &natTable{
+		translation:      make(map[tcpip.Address]tcpip.Address),
+		link:             link,
+		staticVirtualIPs: make(map[string]struct{}),
+	}
+	for source, destination := range configuration.NAT {
+		table.translation[tcpipAddress(net.ParseIP(source))] = tcpipAddress(net.ParseIP(destination))
+	}
+	for _, ip := range virtualIPs {
+		table.staticVirtualIPs[ip] = struct{}{}
+	}
+	return table
+}
+
+func (t *natTable) add(req types.NATRequest) error {
+	virtualIP := net.ParseIP(req.VirtualIP)
+	if virtualIP == nil {
+		return errors.Errorf("invalid virtual IP %q", req.VirtualIP)
+	}
+	hostIP := net.ParseIP(req.HostIP)
+	if hostIP == nil {
+		return errors.Errorf("invalid host IP %q", req.HostIP)
+	}
+	if (virtualIP.To4() == nil) != (hostIP.To4() == nil) {
+		return errors.New("virtual IP and host IP must be of the same family")
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.translation[tcpipAddress(virtualIP)] = tcpipAddress(hostIP)
+	if virtualIP.To4() != nil {
+		t.link.AddVirtualIP(virtualIP.String())
+	}
+	return nil
+}
+
+func (t *natTable) remove(req types.NATRequest) error {
+	virtualIP := net.ParseIP(req.VirtualIP)
+	if virtualIP == nil {
+		return errors.Errorf("invalid virtual IP %q", req.VirtualIP)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	address := tcpipAddress(virtualIP)
+	if _, ok := t.translation[address]; !ok {
+		return errors.Errorf("no translation for %s", virtualIP)
+	}
+	delete(t.translation, address)
+	if _, ok := t.staticVirtualIPs[virtualIP.String()]; !ok {
+		t.link.RemoveVirtualIP(virtualIP.String())
+	}
+	return nil
+}
+
+func (t *natTable) all() []types.NATRequest {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var translations []types.NATRequest
+	for virtualIP, hostIP := range t.translation {
+		translations = append(translations, types.NATRequest{
+			VirtualIP: virtualIP.String(),
+			HostIP:    hostIP.String(),
+		})
+	}
+	sort.Slice(translations, func(i, j int) bool {
+		return translations[i].VirtualIP < translations[j].VirtualIP
+	})
+	return translations
+}
+
+func (t *natTable) Mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/all", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(t.all())
+	})
+	mux.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "post only", http.StatusBadRequest)
+			return
+		}
+		var req types.NATRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := t.add(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/remove", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "post only", http.StatusBadRequest)
+			return
+		}
+		var req types.NATRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := t.remove(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
@@ -0,0 +1,129 @@
+package virtualnetwork
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func natTestTable(t *testing.T) *natTable {
+	link, err := tap.NewLinkEndpoint(false, 1500, "5a:94:ef:e4:0c:dd", "192.168.127.1", []string{"192.168.127.254"})
+	assert.NoError(t, err)
+	return newNATTable(&types.Configuration{
+		NAT: map[string]string{
+			"192.168.127.254": "127.0.0.1",
+		},
+	}, link, []string{"192.168.127.254"})
+}
+
+func natRequest(t *testing.T, handler http.Handler, path string, req types.NATRequest) *httptest.ResponseRecorder {
+	body, err := json.Marshal(req)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	return w
+}
+
+func natTranslations(t *testing.T, handler http.Handler) []types.NATRequest {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/all", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var translations []types.NATRequest
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&translations))
+	return translations
+}
+
+func TestNATAdd(t *testing.T) {
+	table := natTestTable(t)
+	handler := table.Mux()
+
+	w := natRequest(t, handler, "/add", types.NATRequest{VirtualIP: "192.168.127.253", HostIP: "127.0.0.2"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []types.NATRequest{
+		{VirtualIP: "192.168.127.253", HostIP: "127.0.0.2"},
+		{VirtualIP: "192.168.127.254", HostIP: "127.0.0.1"},
+	}, natTranslations(t, handler))
+	assert.Equal(t, tcpipAddress(net.ParseIP("127.0.0.2")), table.translation[tcpipAddress(net.ParseIP("192.168.127.253"))])
+	assert.True(t, table.link.IsVirtualIP("192.168.127.253"))
+
+	// a second add of the same virtual IP replaces its translation
+	w = natRequest(t, handler, "/add", types.NATRequest{VirtualIP: "192.168.127.253", HostIP: "127.0.0.3"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []types.NATRequest{
+		{VirtualIP: "192.168.127.253", HostIP: "127.0.0.3"},
+		{VirtualIP: "192.168.127.254", HostIP: "127.0.0.1"},
+	}, natTranslations(t, handler))
+	assert.Equal(t, tcpipAddress(net.ParseIP("127.0.0.3")), table.translation[tcpipAddress(net.ParseIP("192.168.127.253"))])
+}
+
+func TestNATAddInvalid(t *testing.T) {
+	table := natTestTable(t)
+	handler := table.Mux()
+
+	for _, req := range []types.NATRequest{
+		{VirtualIP: "192.168.127.300", HostIP: "127.0.0.2"},
+		{VirtualIP: "192.168.127.253", HostIP: "localhost"},
+		{VirtualIP: "192.168.127.253", HostIP: "::1"},
+	} {
+		w := natRequest(t, handler, "/add", req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, req)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/add", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Len(t, natTranslations(t, handler), 1)
+}
+
+func TestNATRemove(t *testing.T) {
+	table := natTestTable(t)
+	handler := table.Mux()
+
+	w := natRequest(t, handler, "/add", types.NATRequest{VirtualIP: "192.168.127.253", HostIP: "127.0.0.2"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = natRequest(t, handler, "/remove", types.NATRequest{VirtualIP: "192.168.127.253"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	// the forwarders don't translate the address anymore and the gateway doesn't answer ARP requests about it
+	_, ok := table.translation[tcpipAddress(net.ParseIP("192.168.127.253"))]
+	assert.False(t, ok)
+	assert.False(t, table.link.IsVirtualIP("192.168.127.253"))
+	assert.Equal(t, []types.NATRequest{
+		{VirtualIP: "192.168.127.254", HostIP: "127.0.0.1"},
+	}, natTranslations(t, handler))
+
+	// removed twice
+	w = natRequest(t, handler, "/remove", types.NATRequest{VirtualIP: "192.168.127.253"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestNATRemoveMissing(t *testing.T) {
+	table := natTestTable(t)
+	handler := table.Mux()
+
+	w := natRequest(t, handler, "/remove", types.NATRequest{VirtualIP: "192.168.127.100"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = natRequest(t, handler, "/remove", types.NATRequest{VirtualIP: "invalid"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, natTranslations(t, handler), 1)
+}
+
+func TestNATRemoveStaticVirtualIP(t *testing.T) {
+	table := natTestTable(t)
+	handler := table.Mux()
+
+	// the translation of a virtual IP of the configuration is removed, the gateway keeps answering for it
+	w := natRequest(t, handler, "/remove", types.NATRequest{VirtualIP: "192.168.127.254"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, ok := table.translation[tcpipAddress(net.ParseIP("192.168.127.254"))]
+	assert.False(t, ok)
+	assert.True(t, table.link.IsVirtualIP("192.168.127.254"))
+	assert.Empty(t, natTranslations(t, handler))
+}
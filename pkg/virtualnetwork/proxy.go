@@ -0,0 +1,215 @@
+package virtualnetwork
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/forwarder"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"inet.af/tcpproxy"
+)
+
+const (
+	proxyHandshakeTimeout = 30 * time.Second
+
+	socksVersion = 5
+
+	socksNoAuthentication = 0
+	socksNoAcceptableAuth = 0xff
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded               = 0
+	socksHostUnreachable         = 4
+	socksCommandNotSupported     = 7
+	socksAddressTypeNotSupported = 8
+)
+
+// proxyDialer opens the connection to the host and port asked by a proxy client.
+type proxyDialer func(host string, port string) (net.Conn, error)
+
+// ServeProxy accepts SOCKS5 and HTTP CONNECT proxy connections from the host, and opens their connections
+// in the virtual network. Names are resolved like the DNS server of the gateway would answer to the virtual machines.
+func (n *VirtualNetwork) ServeProxy(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := n.handleProxyConn(conn); err != nil {
+				log.Debugf("proxy: %v", err)
+			}
+		}()
+	}
+}
+
+func (n *VirtualNetwork) handleProxyConn(conn net.Conn) error {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout)); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	var outbound net.Conn
+	if first[0] == socksVersion {
+		outbound, err = socksHandshake(conn, reader, n.dialProxyTarget)
+	} else {
+		outbound, err = httpConnectHandshake(conn, reader, n.dialProxyTarget)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		outbound.Close()
+		return err
+	}
+	remote := tcpproxy.DialProxy{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return outbound, nil
+		},
+	}
+	remote.HandleConn(&forwarder.BufferedConn{Conn: conn, Reader: reader})
+	return nil
+}
+
+// dialProxyTarget opens a connection to the host and port asked by the proxy client.
+func (n *VirtualNetwork) dialProxyTarget(host string, port string) (net.Conn, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips := n.nameserver.Lookup(host)
+		if len(ips) == 0 {
+			return nil, errors.Errorf("cannot resolve %s", host)
+		}
+		ip = ips[0]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proxyHandshakeTimeout)
+	defer cancel()
+	return n.DialContextTCP(ctx, net.JoinHostPort(ip.String(), port))
+}
+
+// socksHandshake handles the CONNECT command of SOCKS5 (RFC 1928), without authentication.
+func socksHandshake(conn net.Conn, reader *bufio.Reader, dial proxyDialer) (net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksNoAcceptableAuth)
+	for _, m := range methods {
+		if m == socksNoAuthentication {
+			method = socksNoAuthentication
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksNoAcceptableAuth {
+		return nil, errors.New("socks: no supported authentication method")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return nil, err
+	}
+	if request[0] != socksVersion {
+		return nil, errors.Errorf("socks: unsupported version %d", request[0])
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if request[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksDomain:
+		size, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		_ = socksReply(conn, socksAddressTypeNotSupported)
+		return nil, errors.Errorf("socks: unsupported address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return nil, err
+	}
+	if request[1] != socksConnect {
+		_ = socksReply(conn, socksCommandNotSupported)
+		return nil, errors.Errorf("socks: unsupported command %d", request[1])
+	}
+
+	outbound, err := dial(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	if err != nil {
+		_ = socksReply(conn, socksHostUnreachable)
+		return nil, err
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		outbound.Close()
+		return nil, err
+	}
+	return outbound, nil
+}
+
+func socksReply(conn net.Conn, code byte) error {
+	// the bound address is not meaningful in the virtual network
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// httpConnectHandshake handles a CONNECT request of a HTTP proxy client.
+func httpConnectHandshake(conn net.Conn, reader *bufio.Reader, dial proxyDialer) (net.Conn, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		_, _ = conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		return nil, errors.Errorf("http: unsupported method %s", req.Method)
+	}
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return nil, err
+	}
+	outbound, err := dial(host, port)
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		outbound.Close()
+		return nil, err
+	}
+	return outbound, nil
+}
@@ -0,0 +1,278 @@
+package virtualnetwork
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyClientConn replays the bytes sent by a proxy client and records the replies of the handshake.
+type proxyClientConn struct {
+	net.Conn
+	replies bytes.Buffer
+}
+
+func (c *proxyClientConn) Write(b []byte) (int, error) {
+	return c.replies.Write(b)
+}
+
+// proxyTarget records the destination of the handshake instead of opening a connection.
+type proxyTarget struct {
+	host string
+	port string
+	err  error
+}
+
+func (p *proxyTarget) dial(host string, port string) (net.Conn, error) {
+	p.host = host
+	p.port = port
+	if p.err != nil {
+		return nil, p.err
+	}
+	local, remote := net.Pipe()
+	remote.Close()
+	return local, nil
+}
+
+var (
+	socksMethodAccepted = []byte{socksVersion, socksNoAuthentication}
+	socksSucceededReply = []byte{socksVersion, socksSucceeded, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+)
+
+func socksReplyOf(code byte) []byte {
+	return []byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+func concat(parts ...[]byte) []byte {
+	var all []byte
+	for _, part := range parts {
+		all = append(all, part...)
+	}
+	return all
+}
+
+func TestSocksHandshake(t *testing.T) {
+	greeting := []byte{socksVersion, 1, socksNoAuthentication}
+	connect := []byte{socksVersion, socksConnect, 0}
+
+	tests := []struct {
+		name    string
+		request []byte
+		dialErr error
+		host    string
+		port    string
+		reply   []byte
+		err     bool
+	}{
+		{
+			name:    "ipv4",
+			request: concat(greeting, connect, []byte{socksIPv4, 192, 168, 127, 2, 0, 80}),
+			host:    "192.168.127.2",
+			port:    "80",
+			reply:   concat(socksMethodAccepted, socksSucceededReply),
+		},
+		{
+			name:    "ipv6",
+			request: concat(greeting, connect, []byte{socksIPv6}, net.ParseIP("fd00::2"), []byte{0x1f, 0x90}),
+			host:    "fd00::2",
+			port:    "8080",
+			reply:   concat(socksMethodAccepted, socksSucceededReply),
+		},
+		{
+			name:    "domain",
+			request: concat(greeting, connect, []byte{socksDomain, 22}, []byte("vm.containers.internal"), []byte{0x01, 0xbb}),
+			host:    "vm.containers.internal",
+			port:    "443",
+			reply:   concat(socksMethodAccepted, socksSucceededReply),
+		},
+		{
+			name:    "no authentication among other methods",
+			request: concat([]byte{socksVersion, 3, 2, 1, socksNoAuthentication}, connect, []byte{socksIPv4, 10, 0, 0, 1, 0, 22}),
+			host:    "10.0.0.1",
+			port:    "22",
+			reply:   concat(socksMethodAccepted, socksSucceededReply),
+		},
+		{
+			name:    "unsupported authentication method",
+			request: []byte{socksVersion, 1, 2},
+			reply:   []byte{socksVersion, socksNoAcceptableAuth},
+			err:     true,
+		},
+		{
+			name:    "no authentication method",
+			request: []byte{socksVersion, 0},
+			reply:   []byte{socksVersion, socksNoAcceptableAuth},
+			err:     true,
+		},
+		{
+			name:    "bad request version",
+			request: concat(greeting, []byte{4, socksConnect, 0, socksIPv4, 10, 0, 0, 1, 0, 22}),
+			reply:   socksMethodAccepted,
+			err:     true,
+		},
+		{
+			name:    "unsupported command",
+			request: concat(greeting, []byte{socksVersion, 2, 0, socksIPv4, 10, 0, 0, 1, 0, 22}),
+			reply:   concat(socksMethodAccepted, socksReplyOf(socksCommandNotSupported)),
+			err:     true,
+		},
+		{
+			name:    "unsupported address type",
+			request: concat(greeting, connect, []byte{2, 10, 0, 0, 1, 0, 22}),
+			reply:   concat(socksMethodAccepted, socksReplyOf(socksAddressTypeNotSupported)),
+			err:     true,
+		},
+		{
+			name:    "unreachable host",
+			request: concat(greeting, connect, []byte{socksIPv4, 10, 0, 0, 1, 0, 22}),
+			dialErr: errors.New("connection refused"),
+			host:    "10.0.0.1",
+			port:    "22",
+			reply:   concat(socksMethodAccepted, socksReplyOf(socksHostUnreachable)),
+			err:     true,
+		},
+		{
+			name:    "truncated greeting",
+			request: []byte{socksVersion},
+			err:     true,
+		},
+		{
+			name:    "truncated methods",
+			request: []byte{socksVersion, 2, socksNoAuthentication},
+			err:     true,
+		},
+		{
+			name:    "truncated request",
+			request: concat(greeting, []byte{socksVersion, socksConnect}),
+			reply:   socksMethodAccepted,
+			err:     true,
+		},
+		{
+			name:    "truncated ipv4 address",
+			request: concat(greeting, connect, []byte{socksIPv4, 10, 0}),
+			reply:   socksMethodAccepted,
+			err:     true,
+		},
+		{
+			name:    "truncated ipv6 address",
+			request: concat(greeting, connect, []byte{socksIPv6}, net.ParseIP("fd00::2")[:8]),
+			reply:   socksMethodAccepted,
+			err:     true,
+		},
+		{
+			name:    "truncated domain",
+			request: concat(greeting, connect, []byte{socksDomain, 20}, []byte("vm")),
+			reply:   socksMethodAccepted,
+			err:     true,
+		},
+		{
+			name:    "missing port",
+			request: concat(greeting, connect, []byte{socksIPv4, 10, 0, 0, 1, 0}),
+			reply:   socksMethodAccepted,
+			err:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &proxyClientConn{}
+			target := &proxyTarget{err: tt.dialErr}
+			outbound, err := socksHandshake(conn, bufio.NewReader(bytes.NewReader(tt.request)), target.dial)
+			if tt.err {
+				assert.Error(t, err)
+				assert.Nil(t, outbound)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, outbound)
+				outbound.Close()
+			}
+			assert.Equal(t, tt.host, target.host)
+			assert.Equal(t, tt.port, target.port)
+			assert.Equal(t, tt.reply, conn.replies.Bytes())
+		})
+	}
+}
+
+func TestHTTPConnectHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		dialErr error
+		host    string
+		port    string
+		reply   string
+		err     bool
+	}{
+		{
+			name:    "connect",
+			request: "CONNECT vm.containers.internal:443 HTTP/1.1\r\nHost: vm.containers.internal:443\r\n\r\n",
+			host:    "vm.containers.internal",
+			port:    "443",
+			reply:   "HTTP/1.1 200 Connection established\r\n\r\n",
+		},
+		{
+			name:    "ipv6",
+			request: "CONNECT [fd00::2]:22 HTTP/1.1\r\n\r\n",
+			host:    "fd00::2",
+			port:    "22",
+			reply:   "HTTP/1.1 200 Connection established\r\n\r\n",
+		},
+		{
+			name:    "unsupported method",
+			request: "GET http://vm.containers.internal/ HTTP/1.1\r\nHost: vm.containers.internal\r\n\r\n",
+			reply:   "HTTP/1.1 405 Method Not Allowed\r\n\r\n",
+			err:     true,
+		},
+		{
+			name:    "missing port",
+			request: "CONNECT vm.containers.internal HTTP/1.1\r\n\r\n",
+			reply:   "HTTP/1.1 400 Bad Request\r\n\r\n",
+			err:     true,
+		},
+		{
+			name:    "bad gateway",
+			request: "CONNECT 192.168.127.2:22 HTTP/1.1\r\n\r\n",
+			dialErr: errors.New("connection refused"),
+			host:    "192.168.127.2",
+			port:    "22",
+			reply:   "HTTP/1.1 502 Bad Gateway\r\n\r\n",
+			err:     true,
+		},
+		{
+			name:    "malformed request line",
+			request: "CONNECT\r\n\r\n",
+			err:     true,
+		},
+		{
+			name:    "bad protocol version",
+			request: "CONNECT 192.168.127.2:22 SOCKS/5\r\n\r\n",
+			err:     true,
+		},
+		{
+			name:    "truncated headers",
+			request: "CONNECT 192.168.127.2:22 HTTP/1.1\r\nHost: 192.168",
+			err:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &proxyClientConn{}
+			target := &proxyTarget{err: tt.dialErr}
+			outbound, err := httpConnectHandshake(conn, bufio.NewReader(bytes.NewBufferString(tt.request)), target.dial)
+			if tt.err {
+				assert.Error(t, err)
+				assert.Nil(t, outbound)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, outbound)
+				outbound.Close()
+			}
+			assert.Equal(t, tt.host, target.host)
+			assert.Equal(t, tt.port, target.port)
+			assert.Equal(t, tt.reply, conn.replies.String())
+		})
+	}
+}
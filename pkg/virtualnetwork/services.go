@@ -4,84 +4,156 @@ import (
 	"net"
 	"net/http"
 	"strings"
-	"sync"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/services/dhcp"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dhcpv6"
 	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/firewall"
 	"github.com/containers/gvisor-tap-vsock/pkg/services/forwarder"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/metadata"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/ndp"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/ntp"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/tftp"
 	"github.com/containers/gvisor-tap-vsock/pkg/tap"
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	log "github.com/sirupsen/logrus"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
 
-func addServices(configuration *types.Configuration, s *stack.Stack, ipPool *tap.IPPool) (http.Handler, error) {
-	var natLock sync.Mutex
-	translation := parseNATTable(configuration)
+func addServices(configuration *types.Configuration, s *stack.Stack, interceptor *packetInterceptor, nat *natTable, networkSwitch *tap.Switch, ipPool *tap.IPPool, ipv6Pool *tap.IPPool) (http.Handler, *dns.Server, error) {
+	resolutions := dns.NewResolutions()
+	fw, err := firewall.New(configuration, resolutions, nat.translation, &nat.lock)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	tcpForwarder := forwarder.TCP(s, translation, &natLock)
-	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
-	udpForwarder := forwarder.UDP(s, translation, &natLock)
-	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	dialer, err := forwarder.NewDialer(configuration, resolutions)
+	if err != nil {
+		return nil, nil, err
+	}
+	tcpForwarder := forwarder.TCPWithDialer(s, nat.translation, &nat.lock, dialer)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, fw.Filter(types.TCP, tcpForwarder.HandlePacket))
+	udpForwarder := forwarder.UDP(s, nat.translation, &nat.lock)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, fw.Filter(types.UDP, udpForwarder.HandlePacket))
+	icmpForwarder, err := forwarder.ICMP(s, nat.translation, &nat.lock, fw.AllowedEcho)
+	if err != nil {
+		return nil, nil, err
+	}
+	interceptor.addHandler(icmpForwarder.HandlePacket)
 
-	dnsMux, err := dnsServer(configuration, s)
+	nameserver, err := dnsServer(configuration, s, resolutions, ipPool, ipv6Pool)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	dhcpMux, err := dhcpServer(configuration, s, ipPool)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if configuration.NTP {
+		if err := ntpServer(configuration, s); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if configuration.TFTPRoot != "" {
+		if err := tftpServer(configuration, s); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var metadataMux http.Handler
+	if configuration.Metadata != nil {
+		metadataMux, err = metadataServer(configuration, s, ipPool)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	forwarderMux, err := forwardHostVM(configuration, s)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	mux := http.NewServeMux()
 	mux.Handle("/forwarder/", http.StripPrefix("/forwarder", forwarderMux))
 	mux.Handle("/dhcp/", http.StripPrefix("/dhcp", dhcpMux))
-	mux.Handle("/dns/", http.StripPrefix("/dns", dnsMux))
-	return mux, nil
+	mux.Handle("/dns/", http.StripPrefix("/dns", nameserver.Mux()))
+	mux.Handle("/nat/", http.StripPrefix("/nat", nat.Mux()))
+	mux.Handle("/firewall/", http.StripPrefix("/firewall", fw.Mux()))
+	if metadataMux != nil {
+		mux.Handle("/metadata/", http.StripPrefix("/metadata", metadataMux))
+	}
+
+	if configuration.IPv6Subnet != "" {
+		if err := ndpServer(configuration, s); err != nil {
+			return nil, nil, err
+		}
+
+		dhcpv6Mux, err := dhcpv6Server(configuration, s, networkSwitch, ipv6Pool)
+		if err != nil {
+			return nil, nil, err
+		}
+		mux.Handle("/dhcpv6/", http.StripPrefix("/dhcpv6", dhcpv6Mux))
+	}
+	return mux, nameserver, nil
 }
 
-func parseNATTable(configuration *types.Configuration) map[tcpip.Address]tcpip.Address {
-	translation := make(map[tcpip.Address]tcpip.Address)
-	for source, destination := range configuration.NAT {
-		translation[tcpip.AddrFrom4Slice(net.ParseIP(source).To4())] = tcpip.AddrFrom4Slice(net.ParseIP(destination).To4())
+func dnsServer(configuration *types.Configuration, s *stack.Stack, resolutions *dns.Resolutions, ipPool *tap.IPPool, ipv6Pool *tap.IPPool) (*dns.Server, error) {
+	udpConn, tcpLn, err := dnsListeners(s, tcpip.AddrFrom4Slice(net.ParseIP(configuration.GatewayIP).To4()), ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := dns.NewWithConfiguration(udpConn, tcpLn, configuration)
+	if err != nil {
+		return nil, err
+	}
+	server.AddLeases(ipPool)
+	server.AddResolutionRecorder(resolutions)
+	if ipv6Pool != nil {
+		server.AddLeases(ipv6Pool)
+	}
+	serveDNS(server)
+
+	if configuration.IPv6Subnet != "" {
+		udpConn, tcpLn, err := dnsListeners(s, tcpip.AddrFrom16Slice(net.ParseIP(configuration.IPv6GatewayIP)), ipv6.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		serveDNS(server.WithListeners(udpConn, tcpLn))
 	}
-	return translation
+	return server, nil
 }
 
-func dnsServer(configuration *types.Configuration, s *stack.Stack) (http.Handler, error) {
+func dnsListeners(s *stack.Stack, addr tcpip.Address, protocol tcpip.NetworkProtocolNumber) (net.PacketConn, net.Listener, error) {
 	udpConn, err := gonet.DialUDP(s, &tcpip.FullAddress{
 		NIC:  1,
-		Addr: tcpip.AddrFrom4Slice(net.ParseIP(configuration.GatewayIP).To4()),
+		Addr: addr,
 		Port: uint16(53),
-	}, nil, ipv4.ProtocolNumber)
+	}, nil, protocol)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	tcpLn, err := gonet.ListenTCP(s, tcpip.FullAddress{
 		NIC:  1,
-		Addr: tcpip.AddrFrom4Slice(net.ParseIP(configuration.GatewayIP).To4()),
+		Addr: addr,
 		Port: uint16(53),
-	}, ipv4.ProtocolNumber)
-	if err != nil {
-		return nil, err
-	}
-
-	server, err := dns.New(udpConn, tcpLn, configuration.DNS)
+	}, protocol)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return udpConn, tcpLn, nil
+}
 
+func serveDNS(server *dns.Server) {
 	go func() {
 		if err := server.Serve(); err != nil {
 			log.Error(err)
@@ -92,7 +164,6 @@ func dnsServer(configuration *types.Configuration, s *stack.Stack) (http.Handler
 			log.Error(err)
 		}
 	}()
-	return server.Mux(), nil
 }
 
 func dhcpServer(configuration *types.Configuration, s *stack.Stack, ipPool *tap.IPPool) (http.Handler, error) {
@@ -106,6 +177,68 @@ func dhcpServer(configuration *types.Configuration, s *stack.Stack, ipPool *tap.
 	return server.Mux(), nil
 }
 
+func ntpServer(configuration *types.Configuration, s *stack.Stack) error {
+	server, err := ntp.New(configuration, s)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Error(server.Serve())
+	}()
+	return nil
+}
+
+func tftpServer(configuration *types.Configuration, s *stack.Stack) error {
+	server, err := tftp.New(configuration, s)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Error(server.Serve())
+	}()
+	return nil
+}
+
+func metadataServer(configuration *types.Configuration, s *stack.Stack, ipPool *tap.IPPool) (http.Handler, error) {
+	server, err := metadata.New(configuration, s, ipPool)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		log.Error(server.Serve())
+	}()
+	return server.Mux(), nil
+}
+
+func ndpServer(configuration *types.Configuration, s *stack.Stack) error {
+	server, err := ndp.New(configuration, s)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Error(server.Serve())
+	}()
+	return nil
+}
+
+func dhcpv6Server(configuration *types.Configuration, s *stack.Stack, networkSwitch *tap.Switch, ipPool *tap.IPPool) (http.Handler, error) {
+	server, err := dhcpv6.New(configuration, s, ipPool)
+	if err != nil {
+		return nil, err
+	}
+	if configuration.PortSecurity {
+		// the leases are checked against the MAC address of the clients, whatever their DUID
+		server.SetLinkAddressResolver(func(ip net.IP) (net.HardwareAddr, bool) {
+			mac, ok := networkSwitch.IPv6LinkAddress(ip)
+			return net.HardwareAddr(mac), ok
+		})
+	}
+	go func() {
+		log.Error(server.Serve())
+	}()
+	return server.Mux(), nil
+}
+
 func forwardHostVM(configuration *types.Configuration, s *stack.Stack) (http.Handler, error) {
 	fw := forwarder.NewPortsForwarder(s)
 	for local, remote := range configuration.Forwards {
@@ -5,7 +5,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/metadata"
 	"github.com/containers/gvisor-tap-vsock/pkg/tap"
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	"github.com/pkg/errors"
@@ -13,8 +16,10 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
 	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/raw"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
@@ -25,6 +30,8 @@ type VirtualNetwork struct {
 	networkSwitch *tap.Switch
 	servicesMux   http.Handler
 	ipPool        *tap.IPPool
+	ipv6Pool      *tap.IPPool
+	nameserver    *dns.Server
 }
 
 func New(configuration *types.Configuration) (*VirtualNetwork, error) {
@@ -40,12 +47,46 @@ func New(configuration *types.Configuration) (*VirtualNetwork, error) {
 	for ip, mac := range configuration.DHCPStaticLeases {
 		ipPool.Reserve(net.ParseIP(ip), mac)
 	}
+	if configuration.DHCPLeaseFile != "" {
+		if err := ipPool.UseDatabase(configuration.DHCPLeaseFile); err != nil {
+			return nil, errors.Wrap(err, "cannot load DHCP leases")
+		}
+	}
+
+	var ipv6Pool *tap.IPPool
+	if configuration.IPv6Subnet != "" {
+		_, subnetIPv6, err := net.ParseCIDR(configuration.IPv6Subnet)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse IPv6 subnet cidr")
+		}
+		ipv6Pool = tap.NewIPPool(subnetIPv6)
+		ipv6Pool.Reserve(net.ParseIP(configuration.IPv6GatewayIP), configuration.GatewayMacAddress)
+	}
 
-	tapEndpoint, err := tap.NewLinkEndpoint(configuration.Debug, configuration.MTU, configuration.GatewayMacAddress, configuration.GatewayIP, configuration.GatewayVirtualIPs)
+	virtualIPs := configuration.GatewayVirtualIPs
+	if configuration.Metadata != nil {
+		// Answer ARP requests of the VMs having a link-local route
+		virtualIPs = append(append([]string{}, virtualIPs...), metadata.IP)
+	}
+	tapEndpoint, err := tap.NewLinkEndpoint(configuration.Debug, configuration.MTU, configuration.GatewayMacAddress, configuration.GatewayIP, virtualIPs)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot create tap endpoint")
 	}
 	networkSwitch := tap.NewSwitch(configuration.Debug, configuration.MTU)
+	if err := networkSwitch.SetTxQueue(configuration.TxQueueLength, configuration.TxDropPolicy); err != nil {
+		return nil, errors.Wrap(err, "cannot configure the transmit queues")
+	}
+	if err := networkSwitch.SetDatagramBatchSize(configuration.DatagramBatchSize); err != nil {
+		return nil, errors.Wrap(err, "cannot configure the datagram batches")
+	}
+	if err := networkSwitch.SetCAM(time.Duration(configuration.CAMAgingTime)*time.Second, configuration.CAMMaxAddresses); err != nil {
+		return nil, errors.Wrap(err, "cannot configure the switch")
+	}
+	if configuration.PortSecurity {
+		if err := networkSwitch.EnablePortSecurity(ipPool, ipv6Pool); err != nil {
+			return nil, errors.Wrap(err, "cannot enable port security")
+		}
+	}
 	tapEndpoint.Connect(networkSwitch)
 	networkSwitch.Connect(tapEndpoint)
 
@@ -63,12 +104,14 @@ func New(configuration *types.Configuration) (*VirtualNetwork, error) {
 		endpoint = tapEndpoint
 	}
 
-	stack, err := createStack(configuration, endpoint)
+	interceptor := newPacketInterceptor(endpoint)
+	stack, err := createStack(configuration, interceptor)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot create network stack")
 	}
 
-	mux, err := addServices(configuration, stack, ipPool)
+	nat := newNATTable(configuration, tapEndpoint, virtualIPs)
+	mux, nameserver, err := addServices(configuration, stack, interceptor, nat, networkSwitch, ipPool, ipv6Pool)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot add network services")
 	}
@@ -79,6 +122,8 @@ func New(configuration *types.Configuration) (*VirtualNetwork, error) {
 		networkSwitch: networkSwitch,
 		servicesMux:   mux,
 		ipPool:        ipPool,
+		ipv6Pool:      ipv6Pool,
+		nameserver:    nameserver,
 	}, nil
 }
 
@@ -96,17 +141,38 @@ func (n *VirtualNetwork) BytesReceived() uint64 {
 	return n.networkSwitch.Received
 }
 
+// leases returns the IPv4 and IPv6 leases of the virtual network.
+func (n *VirtualNetwork) leases() map[string]string {
+	leases := n.ipPool.Leases()
+	if n.ipv6Pool != nil {
+		for ip, mac := range n.ipv6Pool.Leases() {
+			leases[ip] = mac
+		}
+	}
+	return leases
+}
+
 func createStack(configuration *types.Configuration, endpoint stack.LinkEndpoint) (*stack.Stack, error) {
 	s := stack.New(stack.Options{
 		NetworkProtocols: []stack.NetworkProtocolFactory{
 			ipv4.NewProtocol,
 			arp.NewProtocol,
+			ipv6.NewProtocolWithOptions(ipv6.Options{
+				// The gateway is the router of the virtual network, it must not autoconfigure itself from RAs.
+				NDPConfigs: ipv6.NDPConfigurations{
+					HandleRAs: ipv6.HandlingRAsDisabled,
+				},
+				AutoGenLinkLocal: true,
+			}),
 		},
 		TransportProtocols: []stack.TransportProtocolFactory{
 			tcp.NewProtocol,
 			udp.NewProtocol,
 			icmp.NewProtocol4,
+			icmp.NewProtocol6,
 		},
+		// Needed by the NDP service to send router advertisements
+		RawFactory: raw.EndpointFactory{},
 	})
 
 	if err := s.CreateNIC(1, endpoint); err != nil {
@@ -132,13 +198,41 @@ func createStack(configuration *types.Configuration, endpoint stack.LinkEndpoint
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot parse subnet")
 	}
-	s.SetRouteTable([]tcpip.Route{
+	routes := []tcpip.Route{
 		{
 			Destination: subnet,
 			Gateway:     tcpip.Address{},
 			NIC:         1,
 		},
-	})
+	}
+
+	if configuration.IPv6Subnet != "" {
+		gatewayIPv6 := net.ParseIP(configuration.IPv6GatewayIP)
+		if gatewayIPv6 == nil || gatewayIPv6.To4() != nil {
+			return nil, errors.Errorf("invalid IPv6 gateway address %q", configuration.IPv6GatewayIP)
+		}
+		if err := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+			Protocol:          ipv6.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddrFrom16Slice(gatewayIPv6).WithPrefix(),
+		}, stack.AddressProperties{}); err != nil {
+			return nil, errors.New(err.String())
+		}
+
+		_, parsedSubnetIPv6, err := net.ParseCIDR(configuration.IPv6Subnet)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse IPv6 cidr")
+		}
+		subnetIPv6, err := tcpip.NewSubnet(tcpip.AddrFromSlice(parsedSubnetIPv6.IP), tcpip.MaskFromBytes(parsedSubnetIPv6.Mask))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse IPv6 subnet")
+		}
+		routes = append(routes, tcpip.Route{
+			Destination: subnetIPv6,
+			Gateway:     tcpip.Address{},
+			NIC:         1,
+		})
+	}
+	s.SetRouteTable(routes)
 
 	return s, nil
 }